@@ -0,0 +1,312 @@
+package cmd
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/fatih/color"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+
+	"wiretap/transport/mapping"
+	"wiretap/transport/upstream"
+)
+
+type mappingCmdConfig struct {
+	configFile string
+	hosts      string
+	file       string
+	prefix     string
+	prefix6    string
+	dial       bool
+	timeout    time.Duration
+}
+
+// Defaults for mapping commands.
+// See root command for shared defaults.
+var mappingCmdArgs = mappingCmdConfig{
+	configFile: "",
+	timeout:    5 * time.Second,
+}
+
+// mappingCmd represents the mapping command.
+var mappingCmd = &cobra.Command{
+	Use:   "mapping",
+	Short: "Check the host mapping configuration",
+	Long:  `Check the host mapping configuration of serve before deploying it, read from the same config file and environment`,
+}
+
+// Add commands and set flags.
+func init() {
+	rootCmd.AddCommand(mappingCmd)
+
+	mappingCmd.PersistentFlags().StringVarP(&mappingCmdArgs.configFile, "config-file", "f", mappingCmdArgs.configFile, "wireguard config file to read from")
+	mappingCmd.PersistentFlags().StringVarP(&mappingCmdArgs.hosts, "hosts", "", mappingCmdArgs.hosts, "hosts to map, overrides Mapping.Hosts (example \"a.com:80:443,b.com:22\")")
+	mappingCmd.PersistentFlags().StringVarP(&mappingCmdArgs.file, "file", "", mappingCmdArgs.file, "mapping file, overrides Mapping.File")
+	mappingCmd.PersistentFlags().StringVarP(&mappingCmdArgs.prefix, "prefix", "", mappingCmdArgs.prefix, "mapping prefix, overrides Mapping.Prefix")
+	mappingCmd.PersistentFlags().StringVarP(&mappingCmdArgs.prefix6, "prefix6", "", mappingCmdArgs.prefix6, "IPv6 mapping prefix, overrides Mapping.Prefix6")
+
+	validateCmd := &cobra.Command{
+		Use:   "validate",
+		Short: "Validate the host mapping",
+		Long:  `Parse the host mapping as serve does and print the mapped address of every host`,
+		Run: func(cmd *cobra.Command, args []string) {
+			mappingCmdArgs.Validate()
+		},
+	}
+
+	testCmd := &cobra.Command{
+		Use:   "test",
+		Short: "Test the host mapping from this machine",
+		Long:  `Validate the host mapping, resolve every host and optionally connect to every TCP port from this machine`,
+		Run: func(cmd *cobra.Command, args []string) {
+			mappingCmdArgs.Test()
+		},
+	}
+	testCmd.Flags().BoolVarP(&mappingCmdArgs.dial, "dial", "d", mappingCmdArgs.dial, "connect to every TCP port of every host")
+	testCmd.Flags().DurationVarP(&mappingCmdArgs.timeout, "timeout", "t", mappingCmdArgs.timeout, "timeout of each connection")
+
+	mappingCmd.AddCommand(validateCmd, testCmd)
+
+	mappingCmd.Flags().SortFlags = false
+	mappingCmd.PersistentFlags().SortFlags = false
+	testCmd.Flags().SortFlags = false
+}
+
+// load reads the mapping configuration like serve and prints the mapped address table. It exits when the
+// configuration is invalid.
+func (c mappingCmdConfig) load() *mapping.Plan {
+	viper.AutomaticEnv()
+	viper.SetEnvPrefix("WIRETAP")
+	viper.SetEnvKeyReplacer(strings.NewReplacer(".", "_"))
+
+	if c.configFile != "" {
+		viper.SetConfigType("ini")
+		viper.SetConfigFile(c.configFile)
+		if err := viper.ReadInConfig(); err != nil {
+			check("error reading config file", err)
+		}
+	}
+
+	for key, value := range map[string]string{
+		"Mapping.Hosts":   c.hosts,
+		"Mapping.File":    c.file,
+		"Mapping.Prefix":  c.prefix,
+		"Mapping.Prefix6": c.prefix6,
+	} {
+		if value != "" {
+			viper.Set(key, value)
+		}
+	}
+
+	mapping.TunnelSubnets = tunnelSubnets()
+	plan, err := mapping.LoadPlan()
+	if err != nil {
+		// Invalid entries are joined, each is listed on its own line.
+		errs := []error{err}
+		if joined, ok := err.(interface{ Unwrap() []error }); ok {
+			errs = joined.Unwrap()
+		}
+		fmt.Fprintf(color.Output, "%s:\n", RedBold("invalid mapping"))
+		for _, entryErr := range errs {
+			fmt.Fprintf(color.Output, "  %v\n", entryErr)
+		}
+		os.Exit(1)
+	}
+	err = upstream.Configure(viper.GetString("Upstream.Proxy"), viper.GetString("Upstream.NoProxy"), viper.GetString("Upstream.Routes"))
+	if err != nil {
+		fmt.Fprintf(color.Output, "%s: %v\n", RedBold("invalid upstream proxy"), err)
+		os.Exit(1)
+	}
+
+	fmt.Fprintf(color.Output, "%s: %s", WhiteBold("prefix"), plan.Prefix)
+	if plan.Prefix6 != "" {
+		fmt.Fprintf(color.Output, " %s", plan.Prefix6)
+	}
+	fmt.Fprintln(color.Output)
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "HOST\tMAPPED\tMAPPED IPV6\tPORTS\tKIND")
+	for _, host := range plan.Hosts {
+		mapped, mapped6 := host.MappedAddress, host.MappedAddress6
+		if host.MappedSubnet != "" {
+			mapped, mapped6 = host.MappedSubnet, ""
+		}
+		if mapped6 == "" {
+			mapped6 = "-"
+		}
+		kind := host.Kind
+		if kind == "" {
+			kind = "-"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", host.Host, mapped, mapped6, portList(host.Ports), kind)
+	}
+	for _, wildcard := range plan.Wildcards {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", wildcard.Host, "on demand", "-", portList(wildcard.Ports), "-")
+	}
+	w.Flush()
+
+	for _, reverse := range plan.Reverse {
+		fmt.Fprintf(color.Output, "%s: %s -> %s\n", WhiteBold("reverse"), reverse.Listen, reverse.Remote)
+	}
+
+	return plan
+}
+
+// Validate parses the host mapping and prints the mapped addresses.
+func (c mappingCmdConfig) Validate() {
+	plan := c.load()
+	fmt.Fprintf(color.Output, "%s: %d hosts, %d wildcards\n", GreenBold("valid"), len(plan.Hosts), len(plan.Wildcards))
+}
+
+// Test resolves every host of the mapping, and dials its TCP ports when requested, then reports each entry.
+// It exits non-zero when any entry fails.
+func (c mappingCmdConfig) Test() {
+	plan := c.load()
+	fmt.Fprintln(color.Output)
+
+	failed := 0
+	for _, host := range plan.Hosts {
+		if !c.testHost(plan, host) {
+			failed++
+		}
+	}
+
+	if failed > 0 {
+		fmt.Fprintf(color.Output, "%s: %d of %d hosts\n", RedBold("failed"), failed, len(plan.Hosts))
+		os.Exit(1)
+	}
+	fmt.Fprintf(color.Output, "%s: %d hosts\n", GreenBold("passed"), len(plan.Hosts))
+}
+
+// testHost prints the report of a host and returns whether it passed.
+func (c mappingCmdConfig) testHost(plan *mapping.Plan, host mapping.PlannedHost) bool {
+	fmt.Fprintf(color.Output, "%s\n", WhiteBold(host.Host))
+
+	if host.Subnet.IsValid() {
+		fmt.Fprintf(color.Output, "  %s: subnet %s, not resolved\n", Green("ok"), host.Subnet)
+		return true
+	}
+
+	ok := true
+	var addrs []net.IP
+	resolved := make(map[string][]net.IP)
+	sources := make(map[string]string)
+	for _, backend := range host.BackendHosts() {
+		ips, source, ttl, err := plan.Resolve(backend)
+		if err != nil {
+			fmt.Fprintf(color.Output, "  %s: resolve %s: %v\n", Red("failed"), backend, err)
+			ok = false
+			continue
+		}
+		details := source
+		if ttl > 0 {
+			details = fmt.Sprintf("%s, ttl %s", source, ttl)
+		}
+		fmt.Fprintf(color.Output, "  %s: %s resolves to %s (%s)\n", Green("ok"), backend, ipList(ips), details)
+		addrs = append(addrs, ips...)
+		resolved[backend] = ips
+		sources[backend] = source
+	}
+
+	if !c.dial || len(addrs) == 0 {
+		return ok
+	}
+
+	// Backends are dialed like the agent does, through the upstream proxy unless bypassed.
+	destinations := make(map[netip.Addr]upstream.Destination)
+	for backend, ips := range resolved {
+		for _, ip := range ips {
+			if addr, found := netip.AddrFromSlice(ip); found {
+				destinations[addr.Unmap()] = upstream.Destination{Host: backend, Proxy: host.Proxy, Pinned: plan.Pinned(host, sources[backend])}
+			}
+		}
+	}
+	upstream.SetDestinations(destinations)
+
+	// Only single TCP ports are dialed, ranges would have to be scanned.
+	var ports []mapping.Port
+	for _, port := range host.Ports {
+		switch {
+		case port.Protocol != mapping.ProtocolTCP:
+			fmt.Fprintf(color.Output, "  %s: %s not probed, %s is not dialed\n", Cyan("skipped"), port, port.Protocol)
+		case port.End == 65535 && port.Number == 1:
+			fmt.Fprintf(color.Output, "  %s: %s not probed, all ports\n", Cyan("skipped"), port)
+		case port.End > port.Number:
+			fmt.Fprintf(color.Output, "  %s: %s not probed, port range\n", Cyan("skipped"), port)
+		default:
+			ports = append(ports, port)
+		}
+	}
+
+	// Routed hosts connect to the backend of each route.
+	if host.Routing != "" {
+		for _, route := range host.Routes {
+			ips := resolved[route.Backend]
+			if len(ips) == 0 {
+				continue
+			}
+			for _, port := range ports {
+				target := route.Port
+				if target == 0 {
+					target = port.Number
+					if port.Target != 0 {
+						target = port.Target
+					}
+				}
+				ok = c.dialAddress(fmt.Sprintf("%s %s", route.Name, port), ips[0], target) && ok
+			}
+		}
+		return ok
+	}
+
+	// Connections go to the first address, as the agent maps a single backend per family.
+	for _, port := range ports {
+		target := port.Number
+		if port.Target != 0 {
+			target = port.Target
+		}
+		ok = c.dialAddress(port.String(), addrs[0], target) && ok
+	}
+	return ok
+}
+
+// dialAddress connects to a port of a backend address, prints the result under label, with the address and port
+// dialed, and returns whether it connected.
+func (c mappingCmdConfig) dialAddress(label string, ip net.IP, port uint16) bool {
+	address := net.JoinHostPort(ip.String(), fmt.Sprint(port))
+	if via := upstream.Via(address); via != upstream.Direct {
+		address = fmt.Sprintf("%s via %s", address, via)
+	}
+
+	start := time.Now()
+	conn, err := upstream.DialTimeout(net.JoinHostPort(ip.String(), fmt.Sprint(port)), c.timeout)
+	if err != nil {
+		fmt.Fprintf(color.Output, "  %s: %s to %s: %v\n", Red("failed"), label, address, err)
+		return false
+	}
+	conn.Close()
+	fmt.Fprintf(color.Output, "  %s: %s connected to %s in %f %s\n", Green("ok"), label, address, float64(time.Since(start))/float64(time.Millisecond), Cyan("milliseconds"))
+	return true
+}
+
+func portList(ports []mapping.Port) string {
+	values := make([]string, 0, len(ports))
+	for _, port := range ports {
+		values = append(values, port.String())
+	}
+	return strings.Join(values, ",")
+}
+
+func ipList(ips []net.IP) string {
+	values := make([]string, 0, len(ips))
+	for _, ip := range ips {
+		values = append(values, ip.String())
+	}
+	return strings.Join(values, " ")
+}
@@ -79,6 +79,22 @@ func Execute() {
 	}
 }
 
+// tunnelSubnets returns the subnets the tunnel interfaces are addressed from.
+func tunnelSubnets() []netip.Prefix {
+	return []netip.Prefix{
+		ClientRelaySubnet4,
+		ClientRelaySubnet6,
+		RelaySubnets4,
+		RelaySubnets6,
+		E2EESubnets4,
+		E2EESubnets6,
+		ClientE2EESubnet4,
+		ClientE2EESubnet6,
+		ApiV4Subnets,
+		ApiSubnets,
+	}
+}
+
 // check is a helper function that logs and exits if an error is not nil.
 func check(message string, err error) {
 	if err != nil {
@@ -8,10 +8,12 @@ import (
 	"net/http"
 	"net/netip"
 	"os"
+	"os/signal"
 	"regexp"
 	"strconv"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
 
 	"github.com/spf13/cobra"
@@ -31,7 +33,9 @@ import (
 	"wiretap/transport/mapping"
 	"wiretap/transport/tcp"
 	"wiretap/transport/udp"
+	"wiretap/transport/upstream"
 	"wiretap/transport/userspace"
+	"wiretap/transport/webhook"
 )
 
 type serveCmdConfig struct {
@@ -104,7 +108,7 @@ var wiretapDefault = wiretapDefaultConfig{
 	keepalive:        Keepalive,
 	mtu:              MTU,
 	apiiroDomain:     "app.apiiro.com",
-	mappingPrefix:    "10.1.0",
+	mappingPrefix:    "10.1.0.0/24",
 }
 
 // Add serve command and set flags.
@@ -227,7 +231,12 @@ func init() {
 
 	viper.SetDefault("Apiiro.Domain", wiretapDefault.apiiroDomain)
 
-	viper.SetDefault("Mapping.Prefix", wiretapDefault.mappingPrefix)
+	setMappingDefaults(viper.GetViper())
+
+	viper.SetDefault("Webhook.MaxBodySize", 25<<20)
+	viper.SetDefault("Webhook.MaxQueued", 10000)
+	viper.SetDefault("Webhook.MaxSources", 16)
+	viper.SetDefault("Webhook.RejectedRetention", 7*24*time.Hour)
 
 	cmd.Flags().SortFlags = false
 
@@ -272,6 +281,19 @@ func init() {
 	})
 }
 
+// setMappingDefaults sets the defaults of the mapping settings, also on the instances a reload reads.
+func setMappingDefaults(v *viper.Viper) {
+	v.SetDefault("Mapping.Prefix", wiretapDefault.mappingPrefix)
+	v.SetDefault("Mapping.DNS.Enabled", true)
+	v.SetDefault("Mapping.Wildcard.IdleTimeout", time.Hour)
+	v.SetDefault("Mapping.Wildcard.MaxMappings", 256)
+	v.SetDefault("Mapping.TTL.Min", 30*time.Second)
+	v.SetDefault("Mapping.TTL.Max", 10*time.Minute)
+	v.SetDefault("Mapping.Probe.Enabled", true)
+	v.SetDefault("Mapping.Probe.Interval", time.Minute)
+	v.SetDefault("Mapping.Probe.Timeout", 5*time.Second)
+}
+
 // Run parses/processes/validates args and then connects to peer,
 // proxying traffic from peer into local network.
 func (c serveCmdConfig) Run() {
@@ -314,6 +336,13 @@ func (c serveCmdConfig) Run() {
 
 	log.Println("Initializing")
 
+	// Outbound connections go through the upstream proxy, if any.
+	err := upstream.Configure(viper.GetString("Upstream.Proxy"), viper.GetString("Upstream.NoProxy"), viper.GetString("Upstream.Routes"))
+	check("invalid upstream proxy", err)
+	if proxy := upstream.Proxy(); proxy != "" {
+		log.Println("Upstream proxy:", proxy)
+	}
+
 	// Get server public key
 	publicKey, err := config.GetServerPublicKey()
 	check("Error getting server public key", err)
@@ -542,17 +571,79 @@ func (c serveCmdConfig) Run() {
 
 	// Handlers that require long-running routines:
 
-	// IP mapping now, and every 10 minutes
+	// DNS responder for mapped hostnames, listening before the first mapping lets its queries through.
+	if viper.GetBool("Mapping.DNS.Enabled") {
+		dnsServer, err := mapping.ListenDNS(s, &lock)
+		check("failed to start DNS responder", err)
+		wg.Add(1)
+		go func() {
+			dnsServer.Serve()
+			wg.Done()
+		}()
+	}
+
+	// Send the mapping manifest to the server whenever it changes, until acknowledged.
+	wg.Add(1)
+	go func() {
+		mapping.SyncConfig()
+		wg.Done()
+	}()
+
+	// IP mapping now, and again whenever the records of a mapped host expire
+	mapping.AgentVersion = Version
+	mapping.TunnelSubnets = tunnelSubnets()
 	mapping.SetupFromConfig(s, true)
-	mappingTicker := time.NewTicker(10 * time.Minute)
 	wg.Add(1)
 	go func() {
-		for range mappingTicker.C {
-			mapping.SetupFromConfig(s, false)
+		mapping.RefreshLoop(s)
+		wg.Done()
+	}()
+
+	// Reload the mapping configuration on SIGHUP and when the mapping file changes.
+	reloadSignal := make(chan os.Signal, 1)
+	signal.Notify(reloadSignal, syscall.SIGHUP)
+	wg.Add(1)
+	go func() {
+		for range reloadSignal {
+			log.Println("Reloading mapping configuration")
+			settings, err := c.readSettings()
+			if err != nil {
+				log.Println("Keeping the current mapping configuration:", err)
+				continue
+			}
+			if err := mapping.Reload(s, settings); err != nil {
+				log.Println("Keeping the current mapping configuration:", err)
+			}
 		}
 		wg.Done()
 	}()
 
+	wg.Add(1)
+	go func() {
+		mapping.WatchFile(s)
+		wg.Done()
+	}()
+
+	// Check the mapped backends are reachable.
+	if viper.GetBool("Mapping.Probe.Enabled") {
+		wg.Add(1)
+		go func() {
+			mapping.Probe()
+			wg.Done()
+		}()
+	}
+
+	// Relay webhooks of internal systems to the platform.
+	if viper.GetString("Webhook.Listen") != "" {
+		webhookServer, err := webhook.Listen(transportHandler)
+		check("failed to start webhook relay", err)
+		wg.Add(1)
+		go func() {
+			webhookServer.Serve()
+			wg.Done()
+		}()
+	}
+
 	// Start ICMP Handler.
 	wg.Add(1)
 	go func() {
@@ -582,6 +673,8 @@ func (c serveCmdConfig) Run() {
 	wg.Add(1)
 	go func() {
 		http.HandleFunc("/health", handleHealth(devRelay))
+		http.HandleFunc("/health/mappings", mapping.HandleProbes)
+		http.HandleFunc("/health/webhooks", webhook.HandleStatus)
 		log.Fatal(http.ListenAndServe(":8080", nil))
 		wg.Done()
 	}()
@@ -589,6 +682,25 @@ func (c serveCmdConfig) Run() {
 	wg.Wait()
 }
 
+// readSettings reads the environment and config file again into a new viper instance. The global one is read
+// by every goroutine and must not change once serving.
+func (c serveCmdConfig) readSettings() (*viper.Viper, error) {
+	settings := viper.New()
+	settings.AutomaticEnv()
+	settings.SetEnvPrefix("WIRETAP")
+	settings.SetEnvKeyReplacer(strings.NewReplacer(".", "_"))
+	setMappingDefaults(settings)
+
+	if c.configFile != "" {
+		settings.SetConfigType("ini")
+		settings.SetConfigFile(c.configFile)
+		if err := settings.ReadInConfig(); err != nil {
+			return nil, err
+		}
+	}
+	return settings, nil
+}
+
 func handleHealth(devRelay *device.Device) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		ipc, err := devRelay.IpcGet()
@@ -623,6 +735,20 @@ func handleHealth(devRelay *device.Device) http.HandlerFunc {
 			writeErr(w, err)
 			return
 		}
+
+		synced, syncedAt, pending := mapping.SyncStatus()
+		if synced != "" {
+			_, err = io.WriteString(w, "\nMapping revision: "+synced+" synced at "+syncedAt.UTC().Format(time.RFC3339))
+		} else {
+			_, err = io.WriteString(w, "\nMapping revision: not synced")
+		}
+		if err == nil && pending != "" {
+			_, err = io.WriteString(w, "\nPending mapping revision: "+pending)
+		}
+		if err != nil {
+			writeErr(w, err)
+			return
+		}
 	}
 }
 
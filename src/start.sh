@@ -7,7 +7,36 @@ WIRETAP_RELAY_INTERFACE_MTU=$RELAY_MTU \
 WIRETAP_RELAY_PEER_ENDPOINT=$APIIRO_ENDPOINT \
 WIRETAP_SIMPLE=true \
 WIRETAP_MAPPING_PREFIX=$MAPPING_PREFIX \
+WIRETAP_MAPPING_PREFIX6=$MAPPING_PREFIX6 \
 WIRETAP_MAPPING_HOSTS=$MAPPING_HOSTS \
+WIRETAP_MAPPING_FILE=$MAPPING_FILE \
+WIRETAP_MAPPING_STATEDIR=$MAPPING_STATE_DIR \
+WIRETAP_MAPPING_DNS_ENABLED=$MAPPING_DNS_ENABLED \
+WIRETAP_MAPPING_DNS_ADDRESS=$MAPPING_DNS_ADDRESS \
+WIRETAP_MAPPING_WILDCARD_IDLETIMEOUT=$MAPPING_WILDCARD_IDLE_TIMEOUT \
+WIRETAP_MAPPING_WILDCARD_MAXMAPPINGS=$MAPPING_WILDCARD_MAX_MAPPINGS \
+WIRETAP_MAPPING_RESOLVER=$MAPPING_RESOLVER \
+WIRETAP_MAPPING_OVERRIDES=$MAPPING_OVERRIDES \
+WIRETAP_MAPPING_TTL_MIN=$MAPPING_TTL_MIN \
+WIRETAP_MAPPING_TTL_MAX=$MAPPING_TTL_MAX \
+WIRETAP_MAPPING_PROBE_ENABLED=$MAPPING_PROBE_ENABLED \
+WIRETAP_MAPPING_PROBE_INTERVAL=$MAPPING_PROBE_INTERVAL \
+WIRETAP_MAPPING_PROBE_TIMEOUT=$MAPPING_PROBE_TIMEOUT \
+WIRETAP_MAPPING_PROBE_TLSPORTS=$MAPPING_PROBE_TLS_PORTS \
+WIRETAP_MAPPING_REVERSE=$MAPPING_REVERSE \
+WIRETAP_UPSTREAM_PROXY=$UPSTREAM_PROXY \
+WIRETAP_UPSTREAM_NOPROXY=$UPSTREAM_NO_PROXY \
+WIRETAP_UPSTREAM_ROUTES=$UPSTREAM_ROUTES \
+WIRETAP_WEBHOOK_LISTEN=$WEBHOOK_LISTEN \
+WIRETAP_WEBHOOK_DIR=$WEBHOOK_DIR \
+WIRETAP_WEBHOOK_URL=$WEBHOOK_URL \
+WIRETAP_WEBHOOK_SECRET=$WEBHOOK_SECRET \
+WIRETAP_WEBHOOK_INSECURE=$WEBHOOK_INSECURE \
+WIRETAP_WEBHOOK_SOURCES=$WEBHOOK_SOURCES \
+WIRETAP_WEBHOOK_MAXSOURCES=$WEBHOOK_MAX_SOURCES \
+WIRETAP_WEBHOOK_MAXBODYSIZE=$WEBHOOK_MAX_BODY_SIZE \
+WIRETAP_WEBHOOK_MAXQUEUED=$WEBHOOK_MAX_QUEUED \
+WIRETAP_WEBHOOK_REJECTEDRETENTION=$WEBHOOK_REJECTED_RETENTION \
 WIRETAP_CONFIG_TOKEN=$CONFIG_TOKEN \
 WIRETAP_APIIRO_DOMAIN=$APIIRO_DOMAIN \
 WIRETAP_SKIP_SSL_VERIFY=$SKIP_SSL_VERIFY \
@@ -0,0 +1,362 @@
+package mapping
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/spf13/viper"
+)
+
+const allocationFile = "mapping.json"
+
+// allocationState is the persisted form of the allocator.
+type allocationState struct {
+	Prefix string
+	Orders map[string]int
+}
+
+// allocator assigns every host a mapped order that survives reordering of the hosts list
+// and, when a state directory is configured, restarts. The orders of removed hosts are kept for them, so
+// that they get their address back when added again and gateway references never reach another backend.
+type allocator struct {
+	lock   sync.Mutex
+	loaded bool
+	orders map[string]int
+	// readOnly allocators read the persisted orders but never update them.
+	readOnly bool
+	// savedPrefix and saved are the last persisted state, it is written again only when it changes.
+	savedPrefix netip.Prefix
+	saved       map[string]int
+}
+
+var allocations allocator
+
+// assign sets the Order of every mapping. Explicit addresses take precedence, hosts keep
+// their previous order when possible and new hosts get the lowest order that was never used.
+// Orders of removed hosts are only taken once the prefix has no other room left.
+// Subnet mappings take a block of orders aligned to their size.
+func (a *allocator) assign(hostMappings []HostMapping, prefix netip.Prefix, prefix6 netip.Prefix) error {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	if !a.loaded {
+		a.orders = loadAllocations()
+		a.loaded = true
+	}
+
+	// Hosts are mapped at the same order in both prefixes, subnets only in the prefix of their family.
+	capacity := prefixCapacity(prefix)
+	if prefix6.IsValid() && prefixCapacity(prefix6) < capacity {
+		capacity = prefixCapacity(prefix6)
+	}
+	capacityOf := func(m *HostMapping) int {
+		if !m.Subnet.IsValid() {
+			return capacity
+		}
+		if m.Subnet.Addr().Is6() {
+			return prefixCapacity(prefix6)
+		}
+		return prefixCapacity(prefix)
+	}
+
+	// Orders of a previous assignment are found again through the persisted orders.
+	for i := range hostMappings {
+		hostMappings[i].Order = 0
+	}
+
+	keys := mappingKeys(hostMappings)
+	used := make(map[int]string)
+
+	// Orders of hosts that are not mapped now stay reserved for them.
+	present := make(map[string]bool, len(keys))
+	for _, key := range keys {
+		present[key] = true
+	}
+	reserved := make(map[int]string)
+	for key, order := range a.orders {
+		if present[key] {
+			continue
+		}
+		for o := order; o < order+keyBlockSize(key); o++ {
+			reserved[o] = key
+		}
+	}
+
+	// fits returns whether the block of m starting at order is aligned and within the prefix.
+	fits := func(m *HostMapping, order int) bool {
+		size := m.blockSize()
+		return order >= 1 && order%size == 0 && order+size-1 <= capacityOf(m)
+	}
+	free := func(order int, size int) bool {
+		for o := order; o < order+size; o++ {
+			if _, ok := used[o]; ok {
+				return false
+			}
+		}
+		return true
+	}
+	take := func(m *HostMapping, order int) {
+		for o := order; o < order+m.blockSize(); o++ {
+			used[o] = m.Host
+		}
+		m.Order = order
+	}
+
+	// Explicit addresses first. Hosts may share an address as long as their mapped ports differ.
+	claimed := make(map[int][]*HostMapping)
+	for i := range hostMappings {
+		m := &hostMappings[i]
+		if !m.Address.IsValid() {
+			continue
+		}
+
+		order, err := addrOrder(m.Address, prefix, prefix6)
+		if err != nil {
+			return fmt.Errorf("host %s: %w", m.Host, err)
+		}
+		size := m.blockSize()
+		if !fits(m, order) {
+			return fmt.Errorf("host %s: address %s does not start an aligned block of %d addresses in the mapping prefix", m.Host, m.Address, size)
+		}
+		for o := order; o < order+size; o++ {
+			for _, other := range claimed[o] {
+				if size > 1 || other.blockSize() > 1 {
+					return fmt.Errorf("host %s: address %s overlaps %s", m.Host, m.Address, other.Host)
+				}
+				for _, port := range m.Ports {
+					for _, otherPort := range other.Ports {
+						if port.overlaps(otherPort) {
+							return fmt.Errorf("host %s: port %s of address %s is already mapped to %s", m.Host, port, m.Address, other.Host)
+						}
+					}
+				}
+			}
+			claimed[o] = append(claimed[o], m)
+		}
+		if free(order, size) {
+			take(m, order)
+		}
+		m.Order = order
+	}
+
+	// Previous assignments, unless taken by an explicit address.
+	for i := range hostMappings {
+		m := &hostMappings[i]
+		if m.Order != 0 {
+			continue
+		}
+
+		order, ok := a.orders[keys[i]]
+		previous := ok
+		if !ok {
+			// A host mapped once before it was repeated keeps its order for one of its entries.
+			order, ok = a.orders[strings.ToLower(m.Host)]
+		}
+		if !ok || !fits(m, order) {
+			continue
+		}
+		if !free(order, m.blockSize()) {
+			if previous {
+				log.Printf("Host %s loses mapped order %d\n", m.Host, order)
+			}
+			continue
+		}
+		take(m, order)
+	}
+
+	// unreserved returns whether no removed host holds an order of the block.
+	unreserved := func(order int, size int) bool {
+		for o := order; o < order+size; o++ {
+			if _, ok := reserved[o]; ok {
+				return false
+			}
+		}
+		return true
+	}
+
+	// Everything else gets the lowest free block that was never used, or else the lowest free block,
+	// subnets first so they do not fragment the prefix.
+	for _, subnets := range []bool{true, false} {
+		for i := range hostMappings {
+			m := &hostMappings[i]
+			if m.Order != 0 || m.Subnet.IsValid() != subnets {
+				continue
+			}
+
+			size := m.blockSize()
+			order := size
+			for ; fits(m, order) && !(free(order, size) && unreserved(order, size)); order += size {
+			}
+			if !fits(m, order) {
+				for order = size; fits(m, order) && !free(order, size); order += size {
+				}
+			}
+			if !fits(m, order) {
+				return fmt.Errorf("mapping prefix has no room for %s, it fits %d addresses", m.Host, capacityOf(m))
+			}
+			for o := order; o < order+size; o++ {
+				if key, ok := reserved[o]; ok {
+					log.Printf("Host %s takes mapped order %d of removed host %s\n", m.Host, o, key)
+				}
+			}
+			take(m, order)
+		}
+	}
+
+	orders := make(map[string]int, len(a.orders)+len(hostMappings))
+	for key, order := range a.orders {
+		if present[key] {
+			continue
+		}
+		// Removed hosts whose orders were taken are forgotten.
+		if free(order, keyBlockSize(key)) {
+			orders[key] = order
+		}
+	}
+	for i, m := range hostMappings {
+		orders[keys[i]] = m.Order
+	}
+	a.orders = orders
+
+	if a.readOnly || (a.saved != nil && prefix == a.savedPrefix && sameOrders(orders, a.saved)) {
+		return nil
+	}
+	if err := saveAllocations(prefix, orders); err != nil {
+		return err
+	}
+	a.savedPrefix, a.saved = prefix, orders
+	return nil
+}
+
+func sameOrders(a map[string]int, b map[string]int) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for key, order := range a {
+		if other, ok := b[key]; !ok || other != order {
+			return false
+		}
+	}
+	return true
+}
+
+// mappingKeys identifies hosts across configuration changes. Repeated hosts are told apart by their ports,
+// so that reordering their entries keeps their orders, and then by occurrence.
+func mappingKeys(hostMappings []HostMapping) []string {
+	count := make(map[string]int)
+	for _, m := range hostMappings {
+		count[strings.ToLower(m.Host)]++
+	}
+
+	keys := make([]string, len(hostMappings))
+	seen := make(map[string]int)
+	for i, m := range hostMappings {
+		key := strings.ToLower(m.Host)
+		if count[key] > 1 {
+			ports := make([]string, 0, len(m.Ports))
+			for _, port := range m.Ports {
+				ports = append(ports, port.String())
+			}
+			key = fmt.Sprintf("%s#%s", key, strings.Join(ports, ","))
+		}
+		seen[key]++
+		if seen[key] > 1 {
+			key = fmt.Sprintf("%s#%d", key, seen[key])
+		}
+		keys[i] = key
+	}
+	return keys
+}
+
+// keyBlockSize returns the number of orders the host of a key takes, which is more than one for subnets.
+func keyBlockSize(key string) int {
+	host, _, _ := strings.Cut(key, "#")
+	subnet, err := netip.ParsePrefix(host)
+	if err != nil {
+		return 1
+	}
+	return HostMapping{Subnet: subnet}.blockSize()
+}
+
+// addrOrder returns the order of an explicit mapped address within the matching prefix.
+func addrOrder(addr netip.Addr, prefix netip.Prefix, prefix6 netip.Prefix) (int, error) {
+	p := prefix
+	if addr.Is6() {
+		p = prefix6
+	}
+	if !p.IsValid() || !p.Contains(addr) {
+		return 0, fmt.Errorf("address %s is outside of the mapping prefix", addr)
+	}
+
+	order := addrOffset(p, addr)
+	if order < 1 || order > prefixCapacity(p) {
+		return 0, fmt.Errorf("address %s cannot be mapped in %s", addr, p)
+	}
+	return order, nil
+}
+
+func allocationPath() string {
+	stateDir := viper.GetString("Mapping.StateDir")
+	if stateDir == "" {
+		return ""
+	}
+	return filepath.Join(stateDir, allocationFile)
+}
+
+// loadAllocations reads persisted orders. Orders are relative to the prefix, so they stay valid when it changes.
+func loadAllocations() map[string]int {
+	orders := make(map[string]int)
+
+	path := allocationPath()
+	if path == "" {
+		return orders
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			log.Println("Unable to read mapping allocations", err)
+		}
+		return orders
+	}
+
+	var state allocationState
+	if err := json.Unmarshal(data, &state); err != nil {
+		log.Println("Unable to parse mapping allocations", err)
+		return orders
+	}
+	for key, order := range state.Orders {
+		orders[key] = order
+	}
+	return orders
+}
+
+func saveAllocations(prefix netip.Prefix, orders map[string]int) error {
+	path := allocationPath()
+	if path == "" {
+		return nil
+	}
+
+	data, err := json.MarshalIndent(allocationState{Prefix: prefix.String(), Orders: orders}, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+
+	// Write to a temporary file first so a crash never leaves a truncated state file.
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
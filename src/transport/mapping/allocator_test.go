@@ -0,0 +1,171 @@
+package mapping
+
+import (
+	"net/netip"
+	"reflect"
+	"testing"
+
+	"github.com/spf13/viper"
+)
+
+func TestAllocatorStability(t *testing.T) {
+	type step struct {
+		hosts string
+		// restart assigns with a new allocator, which only knows the persisted orders.
+		restart bool
+		// want are the orders of the hosts, in the order they are listed.
+		want []int
+	}
+
+	tests := []struct {
+		name   string
+		prefix string
+		steps  []step
+	}{
+		{
+			name: "reordered hosts",
+			steps: []step{
+				{hosts: "a.com,b.com,c.com", want: []int{1, 2, 3}},
+				{hosts: "c.com,a.com,b.com", want: []int{3, 1, 2}},
+			},
+		},
+		{
+			name: "restart",
+			steps: []step{
+				{hosts: "a.com,b.com,c.com", want: []int{1, 2, 3}},
+				{hosts: "c.com,b.com,a.com", restart: true, want: []int{3, 2, 1}},
+			},
+		},
+		{
+			name: "removed host keeps its order",
+			steps: []step{
+				{hosts: "a.com,b.com,c.com", want: []int{1, 2, 3}},
+				{hosts: "a.com,c.com", want: []int{1, 3}},
+				{hosts: "a.com,c.com,d.com", want: []int{1, 3, 4}},
+				{hosts: "a.com,b.com,c.com,d.com", want: []int{1, 2, 3, 4}},
+			},
+		},
+		{
+			name: "removed host across a restart",
+			steps: []step{
+				{hosts: "a.com,b.com,c.com", want: []int{1, 2, 3}},
+				{hosts: "d.com,c.com,a.com", restart: true, want: []int{4, 3, 1}},
+				{hosts: "b.com,d.com", restart: true, want: []int{2, 4}},
+			},
+		},
+		{
+			name:   "orders of removed hosts are taken when the prefix is full",
+			prefix: "10.1.0.0/29",
+			steps: []step{
+				{hosts: "a.com,b.com,c.com", want: []int{1, 2, 3}},
+				{hosts: "a.com,c.com,d.com,e.com,f.com", want: []int{1, 3, 4, 5, 6}},
+				{hosts: "a.com,c.com,d.com,e.com,f.com,g.com", want: []int{1, 3, 4, 5, 6, 2}},
+				{hosts: "a.com,b.com,c.com,d.com,e.com,f.com", want: []int{1, 2, 3, 4, 5, 6}},
+			},
+		},
+		{
+			name: "repeated host",
+			steps: []step{
+				{hosts: "a.com:22,a.com:80,b.com", want: []int{1, 2, 3}},
+				{hosts: "b.com,a.com:80,a.com:22", restart: true, want: []int{3, 2, 1}},
+			},
+		},
+		{
+			name: "host repeated later",
+			steps: []step{
+				{hosts: "a.com:22,b.com", want: []int{1, 2}},
+				{hosts: "b.com,a.com:80,a.com:22", want: []int{2, 1, 3}},
+			},
+		},
+		{
+			name: "explicit address takes the order of a host",
+			steps: []step{
+				{hosts: "a.com,b.com", want: []int{1, 2}},
+				{hosts: "a.com,b.com,10.1.0.1=c.com", want: []int{3, 2, 1}},
+				{hosts: "a.com,b.com,10.1.0.1=c.com", restart: true, want: []int{3, 2, 1}},
+			},
+		},
+		{
+			name: "aligned subnets",
+			steps: []step{
+				{hosts: "a.com,10.20.0.0/30", want: []int{1, 4}},
+				{hosts: "10.30.0.0/29,a.com,10.20.0.0/30", restart: true, want: []int{8, 1, 4}},
+			},
+		},
+		{
+			name: "removed subnet keeps its block",
+			steps: []step{
+				{hosts: "10.20.0.0/30,a.com", want: []int{4, 1}},
+				{hosts: "a.com,b.com,c.com,d.com", want: []int{1, 2, 3, 8}},
+			},
+		},
+	}
+
+	prefix6 := netip.MustParsePrefix("fd:16::/120")
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			viper.Set("Mapping.StateDir", t.TempDir())
+			t.Cleanup(func() { viper.Set("Mapping.StateDir", "") })
+
+			prefix := netip.MustParsePrefix("10.1.0.0/24")
+			if test.prefix != "" {
+				prefix = netip.MustParsePrefix(test.prefix)
+			}
+
+			a := &allocator{}
+			for i, step := range test.steps {
+				if step.restart {
+					a = &allocator{}
+				}
+
+				hostMappings, err := parseHostsMapping(step.hosts)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if err := a.assign(hostMappings, prefix, prefix6); err != nil {
+					t.Fatalf("step %d: assign error = %v", i, err)
+				}
+
+				var orders []int
+				for _, m := range hostMappings {
+					orders = append(orders, m.Order)
+				}
+				if !reflect.DeepEqual(orders, step.want) {
+					t.Errorf("step %d: orders of %s = %v, want %v", i, step.hosts, orders, step.want)
+				}
+			}
+		})
+	}
+}
+
+func TestAllocatorErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		hosts   string
+		prefix  string
+		wantErr bool
+	}{
+		{name: "address outside of the prefix", hosts: "10.2.0.1=a.com", prefix: "10.1.0.0/24", wantErr: true},
+		{name: "unaligned subnet address", hosts: "10.1.0.2/30=10.20.0.0/30", prefix: "10.1.0.0/24", wantErr: true},
+		{name: "shared address on other ports", hosts: "10.1.0.1=a.com:80,10.1.0.1=b.com:443", prefix: "10.1.0.0/24"},
+		{name: "shared address on the same port", hosts: "10.1.0.1=a.com:80,10.1.0.1=b.com:80", prefix: "10.1.0.0/24", wantErr: true},
+		{name: "prefix full", hosts: "a.com,b.com,c.com", prefix: "10.1.0.0/30", wantErr: true},
+		{name: "prefix just fits", hosts: "a.com,b.com", prefix: "10.1.0.0/30"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			hostMappings, err := parseHostsMapping(test.hosts)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			a := &allocator{readOnly: true}
+			err = a.assign(hostMappings, netip.MustParsePrefix(test.prefix), netip.Prefix{})
+			if (err != nil) != test.wantErr {
+				t.Errorf("assign(%q) error = %v, want error %v", test.hosts, err, test.wantErr)
+			}
+		})
+	}
+}
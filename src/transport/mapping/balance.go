@@ -0,0 +1,344 @@
+package mapping
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/netip"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+
+	"wiretap/transport"
+	"wiretap/transport/upstream"
+)
+
+// Balance selects the backend of each new connection to a load balanced mapping.
+type Balance string
+
+const (
+	BalanceRoundRobin       Balance = "round-robin"
+	BalanceLeastConnections Balance = "least-connections"
+)
+
+const (
+	defaultHealthInterval = 10 * time.Second
+	defaultHealthTimeout  = 2 * time.Second
+)
+
+// HealthCheck configures the active TCP checks of the backends of a load balanced mapping.
+// Port defaults to the backend port of the first single TCP port of the mapping.
+type HealthCheck struct {
+	Port     uint16
+	Interval time.Duration
+	Timeout  time.Duration
+}
+
+func parseBalance(value string) (Balance, error) {
+	switch Balance(strings.ToLower(value)) {
+	case BalanceRoundRobin, "":
+		return BalanceRoundRobin, nil
+	case BalanceLeastConnections:
+		return BalanceLeastConnections, nil
+	}
+	return "", fmt.Errorf("unknown balance '%s', expected %s or %s", value, BalanceRoundRobin, BalanceLeastConnections)
+}
+
+// backend is an address of a load balanced mapping. Backends are healthy until a check fails.
+type backend struct {
+	addr    tcpip.Address
+	ip      netip.Addr
+	healthy atomic.Bool
+}
+
+// backendPool holds the backends of a load balanced mapping for one network protocol.
+type backendPool struct {
+	lock     sync.RWMutex
+	name     string
+	backends []*backend
+	balance  Balance
+	health   HealthCheck
+	next     atomic.Uint32
+	stop     chan struct{}
+}
+
+// update replaces the backends of the pool. Backends that remain keep their health.
+func (p *backendPool) update(addrs []tcpip.Address, balance Balance, health HealthCheck) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	existing := make(map[tcpip.Address]*backend, len(p.backends))
+	for _, b := range p.backends {
+		existing[b.addr] = b
+	}
+
+	backends := make([]*backend, 0, len(addrs))
+	for _, addr := range addrs {
+		if b, ok := existing[addr]; ok {
+			backends = append(backends, b)
+			delete(existing, addr)
+			continue
+		}
+		ip, _ := netip.AddrFromSlice(addr.AsSlice())
+		b := &backend{addr: addr, ip: ip}
+		b.healthy.Store(true)
+		backends = append(backends, b)
+		if p.backends != nil {
+			log.Printf("Backend %s of %s added\n", ip, p.name)
+		}
+	}
+	for _, b := range existing {
+		log.Printf("Backend %s of %s removed\n", b.ip, p.name)
+	}
+
+	p.backends = backends
+	p.balance = balance
+	p.health = health
+}
+
+// pick returns the backend of a new connection. Unhealthy backends are skipped, unless all of them are.
+func (p *backendPool) pick() (tcpip.Address, bool) {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+
+	candidates := make([]*backend, 0, len(p.backends))
+	for _, b := range p.backends {
+		if b.healthy.Load() {
+			candidates = append(candidates, b)
+		}
+	}
+	if len(candidates) == 0 {
+		candidates = p.backends
+	}
+	if len(candidates) == 0 {
+		return tcpip.Address{}, false
+	}
+
+	start := int(p.next.Add(1))
+	if p.balance != BalanceLeastConnections {
+		return candidates[start%len(candidates)].addr, true
+	}
+
+	// Ties go round-robin. Connections are counted by the TCP forwarder.
+	best, bestCount := candidates[start%len(candidates)], -1
+	for i := range candidates {
+		b := candidates[(start+i)%len(candidates)]
+		count := transport.GetConnCounts().Count(b.ip)
+		if bestCount < 0 || count < bestCount {
+			best, bestCount = b, count
+		}
+	}
+	return best.addr, true
+}
+
+func (p *backendPool) String() string {
+	p.lock.RLock()
+	defer p.lock.RUnlock()
+
+	addrs := make([]string, 0, len(p.backends))
+	for _, b := range p.backends {
+		addrs = append(addrs, b.ip.String())
+	}
+	return fmt.Sprintf("[%s] %s", strings.Join(addrs, " "), p.balance)
+}
+
+// check runs the health checks of the pool until it is stopped.
+func (p *backendPool) check() {
+	for {
+		p.lock.RLock()
+		backends := append([]*backend(nil), p.backends...)
+		health := p.health
+		p.lock.RUnlock()
+
+		if health.Port != 0 {
+			var wg sync.WaitGroup
+			for _, b := range backends {
+				wg.Add(1)
+				go func(b *backend) {
+					defer wg.Done()
+					conn, err := upstream.DialTimeout(net.JoinHostPort(b.ip.String(), fmt.Sprint(health.Port)), health.Timeout)
+					if err == nil {
+						conn.Close()
+					}
+					healthy := err == nil
+					if b.healthy.Swap(healthy) != healthy {
+						if healthy {
+							log.Printf("Backend %s of %s is healthy\n", b.ip, p.name)
+						} else {
+							log.Printf("Backend %s of %s is unhealthy: %v\n", b.ip, p.name, err)
+						}
+					}
+				}(b)
+			}
+			wg.Wait()
+		}
+
+		select {
+		case <-p.stop:
+			return
+		case <-time.After(health.Interval):
+		}
+	}
+}
+
+// pools are the backend pools by mapped address. They outlive setups so that health is kept.
+var pools = struct {
+	lock   sync.Mutex
+	byAddr map[tcpip.Address]*backendPool
+}{byAddr: make(map[tcpip.Address]*backendPool)}
+
+// poolFor returns the pool of a mapped address with the given backends, starting its checks when new.
+func poolFor(mapped tcpip.Address, mapping HostMapping, addrs []tcpip.Address) *backendPool {
+	pools.lock.Lock()
+	defer pools.lock.Unlock()
+
+	health := mapping.HealthCheck
+	if health.Port == 0 {
+		for _, port := range mapping.Ports {
+			if port.Protocol == ProtocolTCP && !port.isRange() {
+				health.Port = port.backendPort(port.Number)
+				break
+			}
+		}
+	}
+	if health.Interval <= 0 {
+		health.Interval = defaultHealthInterval
+	}
+	if health.Timeout <= 0 {
+		health.Timeout = defaultHealthTimeout
+	}
+
+	pool, ok := pools.byAddr[mapped]
+	if ok && pool.name == mapping.Host {
+		pool.update(addrs, mapping.Balance, health)
+		return pool
+	}
+	if ok {
+		close(pool.stop)
+	}
+
+	pool = &backendPool{name: mapping.Host, stop: make(chan struct{})}
+	pool.update(addrs, mapping.Balance, health)
+	pools.byAddr[mapped] = pool
+	if health.Port == 0 {
+		log.Println("No TCP port to check the backends of", mapping.Host)
+	}
+	go pool.check()
+	return pool
+}
+
+// retainPools stops the pools of mapped addresses that are no longer load balanced.
+func retainPools(targets []target) {
+	pools.lock.Lock()
+	defer pools.lock.Unlock()
+
+	used := make(map[*backendPool]bool)
+	for _, t := range targets {
+		if t.pool != nil {
+			used[t.pool] = true
+		}
+	}
+	for mapped, pool := range pools.byAddr {
+		if !used[pool] {
+			close(pool.stop)
+			delete(pools.byAddr, mapped)
+		}
+	}
+}
+
+// balancedTargets resolves every backend of a load balanced mapping into one target per network protocol.
+func balancedTargets(mapping HostMapping, mappingPrefix netip.Prefix, mappingPrefix6 netip.Prefix, names *nameTable) ([]target, []target) {
+	backends := mapping.Backends
+	if len(backends) == 0 {
+		backends = []string{mapping.Host}
+	}
+
+	var addrs4, addrs6 []tcpip.Address
+	seen := make(map[tcpip.Address]bool)
+	for _, backend := range backends {
+		ips4, ips6, err := resolveIPs(backend)
+		if err != nil {
+			continue
+		}
+		for _, ip := range ips4 {
+			if addr := tcpip.AddrFrom4Slice(ip); !seen[addr] {
+				seen[addr] = true
+				addrs4 = append(addrs4, addr)
+			}
+		}
+		for _, ip := range ips6 {
+			if addr := tcpip.AddrFrom16Slice(ip); !seen[addr] {
+				seen[addr] = true
+				addrs6 = append(addrs6, addr)
+			}
+		}
+	}
+
+	var targets4, targets6 []target
+	if len(addrs4) > 0 {
+		mappedIp, err := mappedAddr(mappingPrefix, mapping.Order)
+		if err != nil {
+			log.Println("Unable to map IP", mapping.Host, err)
+		} else {
+			mapped := tcpip.AddrFrom4(mappedIp.As4())
+			targets4 = append(targets4, target{
+				mapped:   mapped,
+				bits:     32,
+				ports:    mapping.Ports,
+				activity: mapping.activity,
+				pool:     poolFor(mapped, mapping, addrs4),
+			})
+			names.add(mapping.Host, mappedIp)
+		}
+	}
+
+	if len(addrs6) > 0 && mappingPrefix6.IsValid() {
+		mappedIp6, err := mappedAddr(mappingPrefix6, mapping.Order)
+		if err != nil {
+			log.Println("Unable to map IPv6", mapping.Host, err)
+		} else {
+			mapped := tcpip.AddrFrom16(mappedIp6.As16())
+			targets6 = append(targets6, target{
+				mapped:   mapped,
+				bits:     128,
+				ports:    mapping.Ports,
+				activity: mapping.activity,
+				pool:     poolFor(mapped, mapping, addrs6),
+			})
+			names.add(mapping.Host, mappedIp6)
+		}
+	}
+
+	return targets4, targets6
+}
+
+// balanceTarget translates each new connection to a backend picked from a pool.
+type balanceTarget struct {
+	pool     *backendPool
+	port     Port
+	netProto tcpip.NetworkProtocolNumber
+}
+
+// Action implements stack.Target.Action.
+func (bt *balanceTarget) Action(pkt stack.PacketBufferPtr, hook stack.Hook, r *stack.Route, addressEP stack.AddressableEndpoint) (stack.RuleVerdict, int) {
+	destinationPort, ok := destinationPort(pkt)
+	if !ok {
+		return stack.RuleDrop, 0
+	}
+
+	addr, ok := bt.pool.pick()
+	if !ok {
+		return stack.RuleDrop, 0
+	}
+
+	target := stack.DNATTarget{
+		NetworkProtocol: bt.netProto,
+		Addr:            addr,
+		Port:            bt.port.backendPort(destinationPort),
+	}
+	return target.Action(pkt, hook, r, addressEP)
+}
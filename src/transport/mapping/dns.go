@@ -0,0 +1,374 @@
+package mapping
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/spf13/viper"
+	"golang.org/x/net/dns/dnsmessage"
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/adapters/gonet"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv4"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv6"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+)
+
+const (
+	dnsPort = 53
+	// dnsWorkers bounds the queries answered at once. Names under wildcard entries are resolved while
+	// answering, a slow lookup only holds up its own query.
+	dnsWorkers = 64
+	// dnsTTL is short, mappings may change on every setup.
+	dnsTTL = 30
+	// dnsUDPSize is the largest response sent to clients that do not advertise a larger buffer.
+	dnsUDPSize = 512
+)
+
+// nameTable holds the DNS records of the mapped hostnames. A table is never modified once published.
+type nameTable struct {
+	forward map[string][]netip.Addr
+	reverse map[netip.Addr]string
+}
+
+func newNameTable() *nameTable {
+	return &nameTable{
+		forward: make(map[string][]netip.Addr),
+		reverse: make(map[netip.Addr]string),
+	}
+}
+
+// add records the mapped address of a hostname. Hosts given as addresses have no name to answer for.
+func (t *nameTable) add(host string, addr netip.Addr) {
+	if _, err := netip.ParseAddr(host); err == nil {
+		return
+	}
+
+	name := canonicalName(host)
+	t.forward[name] = append(t.forward[name], addr)
+	if _, ok := t.reverse[addr]; !ok {
+		t.reverse[addr] = name
+	}
+}
+
+// clone returns a copy of the table that can be extended.
+func (t *nameTable) clone() *nameTable {
+	clone := newNameTable()
+	for name, addrs := range t.forward {
+		clone.forward[name] = append([]netip.Addr(nil), addrs...)
+	}
+	for addr, name := range t.reverse {
+		clone.reverse[addr] = name
+	}
+	return clone
+}
+
+// nameStore publishes the name table of the current setup to the DNS responder.
+type nameStore struct {
+	lock  sync.RWMutex
+	table *nameTable
+}
+
+var dnsNames = nameStore{table: newNameTable()}
+
+func (n *nameStore) set(table *nameTable) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	n.table = table
+}
+
+func (n *nameStore) get() *nameTable {
+	n.lock.RLock()
+	defer n.lock.RUnlock()
+
+	return n.table
+}
+
+// dnsAddress is where the responder listens, reported to the control plane. Invalid when it is disabled.
+var dnsAddress netip.AddrPort
+
+// DNSServer answers A, AAAA and PTR queries for mapped hostnames inside the netstack.
+type DNSServer struct {
+	conn *gonet.UDPConn
+}
+
+// ListenDNS binds the DNS responder to Mapping.DNS.Address, by default port 53 of the relay address,
+// and lets queries to it through the NAT table.
+func ListenDNS(s *stack.Stack, lock *sync.Mutex) (*DNSServer, error) {
+	address := viper.GetString("Mapping.DNS.Address")
+	if address == "" {
+		address = viper.GetString("Relay.Interface.ipv4")
+	}
+
+	addrPort, err := parseDNSAddress(address)
+	if err != nil {
+		return nil, err
+	}
+
+	err = ensureAddress(s, addrPort.Addr(), lock)
+	if err != nil {
+		return nil, fmt.Errorf("failed to add DNS address %s: %w", addrPort.Addr(), err)
+	}
+
+	var netProto tcpip.NetworkProtocolNumber = ipv4.ProtocolNumber
+	if addrPort.Addr().Is6() {
+		netProto = ipv6.ProtocolNumber
+	}
+
+	lock.Lock()
+	conn, err := gonet.DialUDP(s, &tcpip.FullAddress{
+		Addr: tcpip.AddrFromSlice(addrPort.Addr().AsSlice()),
+		Port: addrPort.Port(),
+	}, nil, netProto)
+	lock.Unlock()
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on %s: %w", addrPort, err)
+	}
+
+	acceptLocal(addrPort.Addr(), Port{Number: addrPort.Port(), Protocol: ProtocolUDP})
+	dnsAddress = addrPort
+
+	log.Println("DNS responder listening on", addrPort)
+	return &DNSServer{conn: conn}, nil
+}
+
+// parseDNSAddress parses an address with an optional port, e.g. "192.168.0.2" or "[fd::2]:5353".
+func parseDNSAddress(address string) (netip.AddrPort, error) {
+	if addr, err := netip.ParseAddr(address); err == nil {
+		return netip.AddrPortFrom(addr, dnsPort), nil
+	}
+
+	addrPort, err := netip.ParseAddrPort(address)
+	if err != nil {
+		return netip.AddrPort{}, fmt.Errorf("invalid DNS address '%s': %w", address, err)
+	}
+	return addrPort, nil
+}
+
+// Serve answers queries until the listener fails. Each query is answered on its own goroutine.
+func (d *DNSServer) Serve() {
+	workers := make(chan struct{}, dnsWorkers)
+	buf := make([]byte, 65535)
+	for {
+		n, addr, err := d.conn.ReadFrom(buf)
+		if err != nil {
+			log.Println("DNS responder stopped:", err)
+			return
+		}
+
+		query := append([]byte(nil), buf[:n]...)
+		workers <- struct{}{}
+		go func() {
+			defer func() { <-workers }()
+			d.answer(query, addr)
+		}()
+	}
+}
+
+// answer sends the response to a query.
+func (d *DNSServer) answer(query []byte, addr net.Addr) {
+	response, err := answerDNS(query, dnsNames.get())
+	if err != nil {
+		if viper.GetBool("verbose") {
+			log.Println("Invalid DNS query from", addr, err)
+		}
+		return
+	}
+
+	_, err = d.conn.WriteTo(response, addr)
+	if err != nil && viper.GetBool("verbose") {
+		log.Println("Failed to send DNS response to", addr, err)
+	}
+}
+
+// answerDNS builds the response to a query. Names of the table and names under wildcard entries are answered,
+// everything else is NXDOMAIN.
+func answerDNS(query []byte, names *nameTable) ([]byte, error) {
+	var parser dnsmessage.Parser
+	header, err := parser.Start(query)
+	if err != nil {
+		return nil, err
+	}
+	if header.Response {
+		return nil, errors.New("not a query")
+	}
+	questions, err := parser.AllQuestions()
+	if err != nil {
+		return nil, err
+	}
+
+	// The client's buffer size, from its OPT record if any.
+	size := dnsUDPSize
+	if err := parser.SkipAllAnswers(); err == nil {
+		if err := parser.SkipAllAuthorities(); err == nil {
+			for {
+				rh, err := parser.AdditionalHeader()
+				if err != nil {
+					break
+				}
+				if rh.Type == dnsmessage.TypeOPT && int(rh.Class) > size {
+					size = int(rh.Class)
+				}
+				if err := parser.SkipAdditional(); err != nil {
+					break
+				}
+			}
+		}
+	}
+
+	response := dnsmessage.Header{
+		ID:               header.ID,
+		Response:         true,
+		OpCode:           header.OpCode,
+		Authoritative:    true,
+		RecursionDesired: header.RecursionDesired,
+	}
+
+	var resources []dnsmessage.Resource
+	switch {
+	case header.OpCode != 0:
+		response.RCode = dnsmessage.RCodeNotImplemented
+	case len(questions) != 1:
+		response.RCode = dnsmessage.RCodeFormatError
+	default:
+		question := questions[0]
+		var found bool
+		resources, found = names.answer(question)
+		if !found && isAddressQuestion(question) {
+			// Names under a wildcard entry are mapped on their first query.
+			table, err := mapOnDemand(question.Name.String())
+			switch {
+			case err == nil:
+				resources, found = table.answer(question)
+			case errors.Is(err, errTooManyMappings):
+				response.RCode = dnsmessage.RCodeServerFailure
+			case !errors.Is(err, errNoWildcard) && !errors.Is(err, errNoSuchHost):
+				log.Println("Unable to map on demand", question.Name.String(), err)
+				response.RCode = dnsmessage.RCodeServerFailure
+			}
+		}
+		if found {
+			touchOnDemand(question.Name.String())
+		} else if response.RCode == dnsmessage.RCodeSuccess {
+			response.RCode = dnsmessage.RCodeNameError
+		}
+	}
+
+	message := dnsmessage.Message{Header: response, Questions: questions, Answers: resources}
+	packed, err := message.Pack()
+	if err != nil {
+		return nil, err
+	}
+	if len(packed) > size {
+		message.Header.Truncated = true
+		message.Answers = nil
+		return message.Pack()
+	}
+	return packed, nil
+}
+
+// answer returns the records for a question and whether the name exists.
+func (t *nameTable) answer(question dnsmessage.Question) ([]dnsmessage.Resource, bool) {
+	if question.Class != dnsmessage.ClassINET && question.Class != dnsmessage.ClassANY {
+		return nil, false
+	}
+
+	rh := dnsmessage.ResourceHeader{
+		Name:  question.Name,
+		Class: dnsmessage.ClassINET,
+		TTL:   dnsTTL,
+	}
+
+	if addr, ok := reverseAddr(question.Name.String()); ok {
+		name, found := t.reverse[addr]
+		if !found {
+			return nil, false
+		}
+		if question.Type != dnsmessage.TypePTR && question.Type != dnsmessage.TypeALL {
+			return nil, true
+		}
+		ptr, err := dnsmessage.NewName(name)
+		if err != nil {
+			return nil, true
+		}
+		return []dnsmessage.Resource{{Header: rh, Body: &dnsmessage.PTRResource{PTR: ptr}}}, true
+	}
+
+	addrs, found := t.forward[canonicalName(question.Name.String())]
+	if !found {
+		return nil, false
+	}
+
+	var resources []dnsmessage.Resource
+	for _, addr := range addrs {
+		switch {
+		case addr.Is4() && (question.Type == dnsmessage.TypeA || question.Type == dnsmessage.TypeALL):
+			resources = append(resources, dnsmessage.Resource{Header: rh, Body: &dnsmessage.AResource{A: addr.As4()}})
+		case addr.Is6() && (question.Type == dnsmessage.TypeAAAA || question.Type == dnsmessage.TypeALL):
+			resources = append(resources, dnsmessage.Resource{Header: rh, Body: &dnsmessage.AAAAResource{AAAA: addr.As16()}})
+		}
+	}
+	return resources, true
+}
+
+func isAddressQuestion(question dnsmessage.Question) bool {
+	return question.Type == dnsmessage.TypeA || question.Type == dnsmessage.TypeAAAA || question.Type == dnsmessage.TypeALL
+}
+
+// canonicalName returns the lowercase, fully qualified form of a hostname.
+func canonicalName(host string) string {
+	name := strings.ToLower(host)
+	if !strings.HasSuffix(name, ".") {
+		name += "."
+	}
+	return name
+}
+
+// reverseAddr returns the address of an in-addr.arpa or ip6.arpa name.
+func reverseAddr(name string) (netip.Addr, bool) {
+	name = strings.TrimSuffix(strings.ToLower(name), ".")
+
+	if rest, ok := strings.CutSuffix(name, ".in-addr.arpa"); ok {
+		labels := strings.Split(rest, ".")
+		if len(labels) != 4 {
+			return netip.Addr{}, false
+		}
+		var addr [4]byte
+		for i, label := range labels {
+			octet, err := strconv.ParseUint(label, 10, 8)
+			if err != nil {
+				return netip.Addr{}, false
+			}
+			addr[3-i] = byte(octet)
+		}
+		return netip.AddrFrom4(addr), true
+	}
+
+	if rest, ok := strings.CutSuffix(name, ".ip6.arpa"); ok {
+		labels := strings.Split(rest, ".")
+		if len(labels) != 32 {
+			return netip.Addr{}, false
+		}
+		nibbles := make([]byte, 32)
+		for i, label := range labels {
+			if len(label) != 1 {
+				return netip.Addr{}, false
+			}
+			nibbles[31-i] = label[0]
+		}
+		var addr [16]byte
+		if _, err := hex.Decode(addr[:], nibbles); err != nil {
+			return netip.Addr{}, false
+		}
+		return netip.AddrFrom16(addr), true
+	}
+
+	return netip.Addr{}, false
+}
@@ -0,0 +1,187 @@
+package mapping
+
+import (
+	"fmt"
+	"net/netip"
+	"strings"
+	"testing"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func TestAnswerDNS(t *testing.T) {
+	names := newNameTable()
+	names.add("a.corp", netip.MustParseAddr("10.1.0.1"))
+	names.add("a.corp", netip.MustParseAddr("fd::1"))
+	names.add("10.20.0.5", netip.MustParseAddr("10.1.0.2"))
+	for i := 0; i < 40; i++ {
+		names.add("many.corp", netip.AddrFrom4([4]byte{10, 2, 0, byte(i)}))
+	}
+
+	type question struct {
+		name  string
+		qtype dnsmessage.Type
+		class dnsmessage.Class
+	}
+	q := func(name string, qtype dnsmessage.Type) question {
+		return question{name: name, qtype: qtype, class: dnsmessage.ClassINET}
+	}
+
+	tests := []struct {
+		name      string
+		opCode    dnsmessage.OpCode
+		questions []question
+		// udpSize is the buffer size of an OPT record, none when 0.
+		udpSize       uint16
+		wantRCode     dnsmessage.RCode
+		wantAnswers   []string
+		wantTruncated bool
+	}{
+		{name: "A", questions: []question{q("a.corp.", dnsmessage.TypeA)}, wantAnswers: []string{"10.1.0.1"}},
+		{name: "AAAA", questions: []question{q("a.corp.", dnsmessage.TypeAAAA)}, wantAnswers: []string{"fd::1"}},
+		{name: "ANY", questions: []question{q("a.corp.", dnsmessage.TypeALL)}, wantAnswers: []string{"10.1.0.1", "fd::1"}},
+		{name: "case insensitive", questions: []question{q("A.Corp.", dnsmessage.TypeA)}, wantAnswers: []string{"10.1.0.1"}},
+		{name: "other type of a mapped name", questions: []question{q("a.corp.", dnsmessage.TypeMX)}},
+		{name: "unknown name", questions: []question{q("b.corp.", dnsmessage.TypeA)}, wantRCode: dnsmessage.RCodeNameError},
+		{name: "host given as address", questions: []question{q("10.20.0.5.", dnsmessage.TypeA)}, wantRCode: dnsmessage.RCodeNameError},
+		{name: "other class", questions: []question{{name: "a.corp.", qtype: dnsmessage.TypeA, class: dnsmessage.ClassCHAOS}}, wantRCode: dnsmessage.RCodeNameError},
+		{name: "PTR", questions: []question{q("1.0.1.10.in-addr.arpa.", dnsmessage.TypePTR)}, wantAnswers: []string{"a.corp."}},
+		{name: "PTR of IPv6", questions: []question{q("1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.d.f.0.0.ip6.arpa.", dnsmessage.TypePTR)}, wantAnswers: []string{"a.corp."}},
+		{name: "PTR of an unmapped address", questions: []question{q("9.0.1.10.in-addr.arpa.", dnsmessage.TypePTR)}, wantRCode: dnsmessage.RCodeNameError},
+		{name: "A of a reverse name", questions: []question{q("1.0.1.10.in-addr.arpa.", dnsmessage.TypeA)}},
+		{name: "not a query", opCode: 2, questions: []question{q("a.corp.", dnsmessage.TypeA)}, wantRCode: dnsmessage.RCodeNotImplemented},
+		{name: "no question", wantRCode: dnsmessage.RCodeFormatError},
+		{name: "two questions", questions: []question{q("a.corp.", dnsmessage.TypeA), q("a.corp.", dnsmessage.TypeAAAA)}, wantRCode: dnsmessage.RCodeFormatError},
+		{name: "truncated", questions: []question{q("many.corp.", dnsmessage.TypeA)}, wantTruncated: true},
+		{name: "larger client buffer", questions: []question{q("many.corp.", dnsmessage.TypeA)}, udpSize: 4096, wantAnswers: manyAnswers(40)},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			builder := dnsmessage.NewBuilder(nil, dnsmessage.Header{ID: 7, OpCode: test.opCode, RecursionDesired: true})
+			builder.EnableCompression()
+			builder.StartQuestions()
+			for _, question := range test.questions {
+				err := builder.Question(dnsmessage.Question{Name: dnsmessage.MustNewName(question.name), Type: question.qtype, Class: question.class})
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			if test.udpSize != 0 {
+				builder.StartAdditionals()
+				var opt dnsmessage.ResourceHeader
+				if err := opt.SetEDNS0(int(test.udpSize), dnsmessage.RCodeSuccess, false); err != nil {
+					t.Fatal(err)
+				}
+				if err := builder.OPTResource(opt, dnsmessage.OPTResource{}); err != nil {
+					t.Fatal(err)
+				}
+			}
+			query, err := builder.Finish()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			packed, err := answerDNS(query, names)
+			if err != nil {
+				t.Fatalf("answerDNS() error = %v", err)
+			}
+			var response dnsmessage.Message
+			if err := response.Unpack(packed); err != nil {
+				t.Fatalf("unpacking the response: %v", err)
+			}
+
+			if response.Header.ID != 7 || !response.Header.Response || !response.Header.RecursionDesired {
+				t.Errorf("header = %+v, want the ID and recursion of the query", response.Header)
+			}
+			if response.Header.RCode != test.wantRCode {
+				t.Errorf("rcode = %s, want %s", response.Header.RCode, test.wantRCode)
+			}
+			if response.Header.Truncated != test.wantTruncated {
+				t.Errorf("truncated = %v, want %v", response.Header.Truncated, test.wantTruncated)
+			}
+			var answers []string
+			for _, answer := range response.Answers {
+				switch body := answer.Body.(type) {
+				case *dnsmessage.AResource:
+					answers = append(answers, netip.AddrFrom4(body.A).String())
+				case *dnsmessage.AAAAResource:
+					answers = append(answers, netip.AddrFrom16(body.AAAA).String())
+				case *dnsmessage.PTRResource:
+					answers = append(answers, body.PTR.String())
+				}
+			}
+			if strings.Join(answers, " ") != strings.Join(test.wantAnswers, " ") {
+				t.Errorf("answers = %v, want %v", answers, test.wantAnswers)
+			}
+		})
+	}
+}
+
+func manyAnswers(count int) []string {
+	var answers []string
+	for i := 0; i < count; i++ {
+		answers = append(answers, fmt.Sprintf("10.2.0.%d", i))
+	}
+	return answers
+}
+
+func TestAnswerDNSMalformed(t *testing.T) {
+	header := []byte{0, 7, 1, 0, 0, 1, 0, 0, 0, 0, 0, 0}
+	question := []byte{1, 'a', 4, 'c', 'o', 'r', 'p', 0, 0, 1, 0, 1}
+
+	tests := []struct {
+		name  string
+		query []byte
+	}{
+		{name: "empty", query: nil},
+		{name: "short header", query: header[:5]},
+		{name: "missing question", query: header},
+		{name: "truncated question", query: append(append([]byte(nil), header...), question[:9]...)},
+		{name: "label past the end", query: append(append([]byte(nil), header...), 9, 'a')},
+		{name: "compression loop", query: append(append([]byte(nil), header...), 0xc0, 12, 0, 1, 0, 1)},
+		{name: "response", query: append([]byte{0, 7, 0x81, 0, 0, 1, 0, 0, 0, 0, 0, 0}, question...)},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if packed, err := answerDNS(test.query, newNameTable()); err == nil {
+				t.Errorf("answerDNS(%x) = %x, want an error", test.query, packed)
+			}
+		})
+	}
+}
+
+func TestReverseAddr(t *testing.T) {
+	tests := []struct {
+		name   string
+		want   string
+		wantOK bool
+	}{
+		{name: "1.0.1.10.in-addr.arpa.", want: "10.1.0.1", wantOK: true},
+		{name: "1.0.1.10.IN-ADDR.ARPA", want: "10.1.0.1", wantOK: true},
+		{name: "1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.d.f.0.0.ip6.arpa.", want: "fd::1", wantOK: true},
+		{name: "1.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.D.F.0.0.IP6.ARPA.", want: "fd::1", wantOK: true},
+		{name: "0.1.10.in-addr.arpa."},
+		{name: "5.1.0.1.10.in-addr.arpa."},
+		{name: "256.0.1.10.in-addr.arpa."},
+		{name: "x.0.1.10.in-addr.arpa."},
+		{name: "0.0.d.f.0.0.ip6.arpa."},
+		{name: "g.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.d.f.0.0.ip6.arpa."},
+		{name: "10.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.d.f.0.0.ip6.arpa."},
+		{name: "a.corp."},
+		{name: "in-addr.arpa."},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			addr, ok := reverseAddr(test.name)
+			if ok != test.wantOK {
+				t.Fatalf("reverseAddr(%q) = %s, %v, want ok %v", test.name, addr, ok, test.wantOK)
+			}
+			if ok && addr != netip.MustParseAddr(test.want) {
+				t.Errorf("reverseAddr(%q) = %s, want %s", test.name, addr, test.want)
+			}
+		})
+	}
+}
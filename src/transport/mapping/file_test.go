@@ -0,0 +1,154 @@
+package mapping
+
+import (
+	"net/netip"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseMappingDocument(t *testing.T) {
+	tcp := func(number uint16) Port { return Port{Number: number, Protocol: ProtocolTCP} }
+
+	tests := []struct {
+		name     string
+		document string
+		want     []HostMapping
+		wantErr  string
+	}{
+		{
+			name:     "empty",
+			document: "",
+		},
+		{
+			name: "shorthand and url entries",
+			document: `
+version: 1
+hosts:
+  - gitlab.corp:80:443
+  - https://jira.corp:8443
+`,
+			want: []HostMapping{
+				{Host: "gitlab.corp", Ports: []Port{tcp(80), tcp(443)}},
+				{Host: "jira.corp", Ports: []Port{tcp(8443)}},
+			},
+		},
+		{
+			name: "host entry",
+			document: `
+hosts:
+  - host: artifactory.corp
+    ports: [80, 443, "53/udp"]
+    address: 10.1.0.9
+    name: Artifactory
+    kind: Artifactory
+    labels: {team: platform}
+    comment: ignored
+`,
+			want: []HostMapping{{
+				Host:    "artifactory.corp",
+				Ports:   []Port{tcp(80), tcp(443), {Number: 53, Protocol: ProtocolUDP}},
+				Address: netip.MustParseAddr("10.1.0.9"),
+				Name:    "Artifactory",
+				Kind:    "artifactory",
+				Labels:  map[string]string{"team": "platform"},
+			}},
+		},
+		{
+			name:     "json",
+			document: `{"version": 1, "hosts": ["a.corp:22", {"host": "b.corp", "ports": [8080]}]}`,
+			want: []HostMapping{
+				{Host: "a.corp", Ports: []Port{tcp(22)}},
+				{Host: "b.corp", Ports: []Port{tcp(8080)}},
+			},
+		},
+		{
+			name: "subnet entry",
+			document: `
+hosts:
+  - host: 10.20.0.0/26
+    address: 10.1.0.64/26
+    ports: [22]
+`,
+			want: []HostMapping{{
+				Host:    "10.20.0.0/26",
+				Ports:   []Port{tcp(22)},
+				Subnet:  netip.MustParsePrefix("10.20.0.0/26"),
+				Address: netip.MustParseAddr("10.1.0.64"),
+			}},
+		},
+		{
+			name: "default routing port",
+			document: `
+hosts:
+  - host: ingress.corp
+    sni:
+      gitlab.corp: gitlab.internal
+`,
+			want: []HostMapping{{
+				Host:    "ingress.corp",
+				Ports:   []Port{tcp(443)},
+				Routing: RoutingSNI,
+				Routes:  []Route{{Name: "gitlab.corp", Backend: "gitlab.internal"}},
+			}},
+		},
+		{
+			name:     "unsupported version",
+			document: "version: 2\nhosts: []\n",
+			wantErr:  "line 1: unsupported version",
+		},
+		{
+			name:     "unknown field",
+			document: "hosts:\n  - host: a.corp\n    port: 22\n",
+			wantErr:  "line 3: unknown field 'port'",
+		},
+		{
+			name:     "hosts not a list",
+			document: "hosts: a.corp\n",
+			wantErr:  "'hosts' must be a list",
+		},
+		{
+			name:     "missing host",
+			document: "hosts:\n  - ports: [22]\n",
+			wantErr:  "line 2: missing 'host'",
+		},
+		{
+			name:     "invalid shorthand",
+			document: "hosts:\n  - a.corp:22\n  - b.corp:http\n",
+			wantErr:  "line 3: invalid port value",
+		},
+		{
+			name:     "load balanced subnet",
+			document: "hosts:\n  - host: 10.20.0.0/26\n    balance: round-robin\n",
+			wantErr:  "cannot be load balanced",
+		},
+		{
+			name:     "routed udp port",
+			document: "hosts:\n  - host: ingress.corp\n    ports: [53/udp]\n    sni: {a.corp: b.corp}\n",
+			wantErr:  "only single TCP ports can",
+		},
+		{
+			name:     "not a mapping",
+			document: "- a.corp\n",
+			wantErr:  "expected a mapping",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			hostMappings, err := parseMappingDocument([]byte(test.document))
+			if test.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+					t.Fatalf("parseMappingDocument() error = %v, want %q", err, test.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseMappingDocument() error = %v", err)
+			}
+			if !reflect.DeepEqual(hostMappings, test.want) {
+				t.Errorf("parseMappingDocument() = %+v, want %+v", hostMappings, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,142 @@
+package mapping
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"sync"
+	"time"
+
+	"wiretap/transport/upstream"
+)
+
+const (
+	// httpHeaderTimeout bounds the wait for the headers of a request routed by Host.
+	httpHeaderTimeout = 30 * time.Second
+	// httpIdleTimeout closes keep-alive connections routed by Host that stay idle.
+	httpIdleTimeout = 2 * time.Minute
+	// noDeadline is how far cleared deadlines of connections routed by Host are set.
+	noDeadline = 100 * 365 * 24 * time.Hour
+)
+
+// httpConn is a connection to a port of a mapping routed by Host.
+type httpConn struct {
+	*proxyConn
+	mapping HostMapping
+	port    Port
+}
+
+// SetDeadline, SetReadDeadline and SetWriteDeadline work around gonet connections, whose deadlines cannot
+// be cleared safely: once they are, a later deadline in the past no longer interrupts a pending read, and the
+// HTTP server relies on that to hijack upgraded connections. Cleared deadlines are set far in the future instead.
+func (c *httpConn) SetDeadline(t time.Time) error {
+	return c.proxyConn.SetDeadline(deadline(t))
+}
+
+func (c *httpConn) SetReadDeadline(t time.Time) error {
+	return c.proxyConn.SetReadDeadline(deadline(t))
+}
+
+func (c *httpConn) SetWriteDeadline(t time.Time) error {
+	return c.proxyConn.SetWriteDeadline(deadline(t))
+}
+
+func deadline(t time.Time) time.Time {
+	if t.IsZero() {
+		return time.Now().Add(noDeadline)
+	}
+	return t
+}
+
+type httpConnKey struct{}
+type httpAddressKey struct{}
+
+// httpListener hands the connections of mappings routed by Host to the HTTP server.
+type httpListener struct {
+	conns chan net.Conn
+}
+
+func (l *httpListener) Accept() (net.Conn, error) {
+	return <-l.conns, nil
+}
+
+func (l *httpListener) Close() error {
+	return nil
+}
+
+func (l *httpListener) Addr() net.Addr {
+	return &net.TCPAddr{}
+}
+
+// httpRouting serves every connection routed by Host. Each request is routed on its own, so keep-alive
+// connections may carry requests for several hosts. Upgraded connections, such as websockets, are spliced
+// to the backend once it switches protocols.
+var httpRouting = struct {
+	once     sync.Once
+	listener *httpListener
+}{listener: &httpListener{conns: make(chan net.Conn)}}
+
+// httpHandler serves the connections to a port of a mapping routed by Host.
+func httpHandler(mapping HostMapping, port Port) proxyHandler {
+	httpRouting.once.Do(startHTTPRouting)
+	return func(conn *proxyConn) {
+		httpRouting.listener.conns <- &httpConn{proxyConn: conn, mapping: mapping, port: port}
+	}
+}
+
+func startHTTPRouting() {
+	proxy := &httputil.ReverseProxy{
+		// The request is forwarded as it is, with its Host header, to the address of its route.
+		Rewrite: func(r *httputil.ProxyRequest) {
+			r.Out.URL.Scheme = "http"
+			r.Out.URL.Host = r.In.Context().Value(httpAddressKey{}).(string)
+		},
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, network string, address string) (net.Conn, error) {
+				ctx, cancel := context.WithTimeout(ctx, backendDialTimeout)
+				defer cancel()
+				return upstream.DialContext(ctx, address)
+			},
+			MaxIdleConnsPerHost: 16,
+			IdleConnTimeout:     httpIdleTimeout,
+		},
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			log.Printf("Unable to forward request for %s to %s: %v\n", r.Host, r.URL.Host, err)
+			http.Error(w, fmt.Sprintf("%s is unreachable", r.Host), http.StatusBadGateway)
+		},
+	}
+
+	server := &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			conn := r.Context().Value(httpConnKey{}).(*httpConn)
+			host := r.Host
+			if name, _, err := net.SplitHostPort(host); err == nil {
+				host = name
+			}
+
+			route, ok := matchRoute(conn.mapping.Routes, host)
+			if !ok {
+				log.Printf("No route for host '%s' on %s:%d\n", host, conn.mapping.Host, conn.port.Number)
+				http.Error(w, fmt.Sprintf("no route for %s", host), http.StatusBadGateway)
+				return
+			}
+			address, err := route.address(conn.port)
+			if err != nil {
+				log.Printf("Unable to resolve %s for host '%s' on %s: %v\n", route.Backend, host, conn.mapping.Host, err)
+				http.Error(w, fmt.Sprintf("%s is unreachable", host), http.StatusBadGateway)
+				return
+			}
+
+			proxy.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), httpAddressKey{}, address)))
+		}),
+		ConnContext: func(ctx context.Context, c net.Conn) context.Context {
+			return context.WithValue(ctx, httpConnKey{}, c)
+		},
+		ReadHeaderTimeout: httpHeaderTimeout,
+		IdleTimeout:       httpIdleTimeout,
+	}
+	go server.Serve(httpRouting.listener)
+}
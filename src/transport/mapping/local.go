@@ -0,0 +1,90 @@
+package mapping
+
+import (
+	"net"
+	"net/netip"
+	"strings"
+	"sync"
+
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv4"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv6"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+
+	"wiretap/transport"
+)
+
+// localService is served by the agent itself inside the netstack.
+type localService struct {
+	addr netip.Addr
+	port Port
+}
+
+// localServices are accepted in prerouting, unlike other traffic that is not mapped.
+var localServices struct {
+	lock     sync.Mutex
+	services []localService
+}
+
+// acceptLocal lets traffic to a service of the agent through the NAT table. It takes effect on the next setup.
+func acceptLocal(addr netip.Addr, port Port) {
+	localServices.lock.Lock()
+	defer localServices.lock.Unlock()
+
+	localServices.services = append(localServices.services, localService{addr: addr, port: port})
+}
+
+// localRules returns the prerouting accept rules of the local services of a network protocol.
+func localRules(netProto tcpip.NetworkProtocolNumber) []stack.Rule {
+	localServices.lock.Lock()
+	defer localServices.lock.Unlock()
+
+	var rules []stack.Rule
+	for _, service := range localServices.services {
+		if service.addr.Is6() != (netProto == ipv6.ProtocolNumber) {
+			continue
+		}
+
+		rules = append(rules, stack.Rule{
+			Filter: stack.IPHeaderFilter{
+				Dst:     tcpip.AddrFromSlice(service.addr.AsSlice()),
+				DstMask: tcpip.AddrFromSlice(net.CIDRMask(service.addr.BitLen(), service.addr.BitLen())),
+			},
+			Target: &stack.AcceptTarget{},
+			Matchers: []stack.Matcher{
+				portMatcher(service.port),
+			},
+		})
+	}
+	return rules
+}
+
+// localServicesKey describes the local services of a network protocol, to notice when they change.
+func localServicesKey(netProto tcpip.NetworkProtocolNumber) string {
+	localServices.lock.Lock()
+	defer localServices.lock.Unlock()
+
+	var key []string
+	for _, service := range localServices.services {
+		if service.addr.Is6() == (netProto == ipv6.ProtocolNumber) {
+			key = append(key, netip.AddrPortFrom(service.addr, service.port.Number).String()+"/"+string(service.port.Protocol))
+		}
+	}
+	return strings.Join(key, ",")
+}
+
+// ensureAddress adds addr to the stack unless the stack already has it.
+func ensureAddress(s *stack.Stack, addr netip.Addr, lock *sync.Mutex) error {
+	var netProto tcpip.NetworkProtocolNumber = ipv4.ProtocolNumber
+	if addr.Is6() {
+		netProto = ipv6.ProtocolNumber
+	}
+
+	lock.Lock()
+	nic := s.CheckLocalAddress(0, netProto, tcpip.AddrFromSlice(addr.AsSlice()))
+	lock.Unlock()
+	if nic != 0 {
+		return nil
+	}
+	return transport.GetConnCounts().AddAddress(addr, s, lock)
+}
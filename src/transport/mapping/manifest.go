@@ -0,0 +1,129 @@
+package mapping
+
+import (
+	"strings"
+
+	"wiretap/transport/upstream"
+)
+
+// ManifestVersion is the version of the configuration sent to the server. Version 1 only had the order,
+// host and mapped addresses of each entry. Fields are only ever added, so older servers ignore them.
+const ManifestVersion = 2
+
+// AgentVersion is the version of the agent reported in the manifest, set on startup.
+var AgentVersion string
+
+// serviceKinds are the kinds of service guessed from host names, the first that appears in a name wins.
+var serviceKinds = []string{
+	"gitlab",
+	"github",
+	"bitbucket",
+	"azure-devops",
+	"jira",
+	"confluence",
+	"artifactory",
+	"nexus",
+	"jenkins",
+	"sonarqube",
+	"harbor",
+	"vault",
+}
+
+// serviceKind returns the configured kind of a mapping, or the kind guessed from its host name.
+func serviceKind(mapping HostMapping) string {
+	if mapping.Kind != "" {
+		return mapping.Kind
+	}
+	if mapping.Subnet.IsValid() {
+		return ""
+	}
+
+	host := strings.ToLower(mapping.Host)
+	for _, kind := range serviceKinds {
+		if strings.Contains(host, kind) {
+			return kind
+		}
+	}
+	return ""
+}
+
+// PortRequest is a mapped port, or range of ports, and the backend port it is translated to.
+type PortRequest struct {
+	Port       uint16
+	End        uint16 `json:",omitempty"`
+	Protocol   string
+	TargetPort uint16 `json:",omitempty"`
+}
+
+func portRequests(ports []Port) []PortRequest {
+	requests := make([]PortRequest, 0, len(ports))
+	for _, port := range ports {
+		request := PortRequest{Port: port.Number, Protocol: string(port.Protocol)}
+		if port.isRange() {
+			request.End = port.last()
+		}
+		if port.Target != 0 && port.Target != port.Number {
+			request.TargetPort = port.Target
+		}
+		requests = append(requests, request)
+	}
+	return requests
+}
+
+// RouteRequest is a route of a routed host, the backend of the connections for a name.
+type RouteRequest struct {
+	Name    string
+	Backend string
+	Port    uint16 `json:",omitempty"`
+}
+
+func routeRequests(routes []Route) []RouteRequest {
+	if len(routes) == 0 {
+		return nil
+	}
+	requests := make([]RouteRequest, 0, len(routes))
+	for _, route := range routes {
+		requests = append(requests, RouteRequest{Name: route.Name, Backend: route.Backend, Port: route.Port})
+	}
+	return requests
+}
+
+// redactedProxy returns the proxy of a mapping without its credentials.
+func redactedProxy(value string) string {
+	u, err := upstream.ParseProxy(value)
+	if err != nil {
+		// The value may hold a password, it is not sent as it is.
+		return "invalid"
+	}
+	if u == nil {
+		return value
+	}
+	return u.Redacted()
+}
+
+// hostResolution reports how the backends of a mapping resolved: the first state other than resolved,
+// the addresses of every backend and the last lookup error.
+func hostResolution(mapping HostMapping) (string, []string, string) {
+	if mapping.Subnet.IsValid() {
+		return "", nil, ""
+	}
+
+	hosts := mapping.BackendHosts()
+
+	state := ""
+	var addresses []string
+	var lastError string
+	for _, host := range hosts {
+		hostState, ips, err := resolutionOf(host)
+		if state == "" || state == resolutionResolved || state == resolutionLiteral || state == resolutionOverride {
+			state = hostState
+		}
+		for _, ip := range ips {
+			addresses = append(addresses, ip.String())
+		}
+		if err != nil {
+			lastError = err.Error()
+		}
+	}
+	return state, addresses, lastError
+}
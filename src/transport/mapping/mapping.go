@@ -3,132 +3,600 @@ package mapping
 import (
 	"fmt"
 	"log"
+	"math"
 	"net"
-	"strconv"
+	"net/netip"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/spf13/viper"
 	"gvisor.dev/gvisor/pkg/tcpip"
-	"gvisor.dev/gvisor/pkg/tcpip/header"
 	"gvisor.dev/gvisor/pkg/tcpip/network/ipv4"
 	"gvisor.dev/gvisor/pkg/tcpip/network/ipv6"
 	"gvisor.dev/gvisor/pkg/tcpip/stack"
 	"gvisor.dev/gvisor/pkg/tcpip/transport/tcp"
+
+	"wiretap/transport/upstream"
+)
+
+// Protocol is the transport protocol of a mapped port.
+type Protocol string
+
+const (
+	ProtocolTCP Protocol = "tcp"
+	ProtocolUDP Protocol = "udp"
 )
 
+// Port is a mapped port, or the range Number-End of mapped ports.
+// Target is the backend port (or first port of the backend range) when it differs from Number.
+type Port struct {
+	Number   uint16
+	End      uint16
+	Protocol Protocol
+	Target   uint16
+}
+
+// last returns the last mapped port of the range.
+func (p Port) last() uint16 {
+	if p.End > p.Number {
+		return p.End
+	}
+	return p.Number
+}
+
+func (p Port) isRange() bool {
+	return p.last() != p.Number
+}
+
+func (p Port) isAll() bool {
+	return p.Number == 1 && p.last() == math.MaxUint16
+}
+
+// backendPort returns the port connections to the mapped port are translated to.
+func (p Port) backendPort(port uint16) uint16 {
+	if p.Target != 0 {
+		return p.Target + (port - p.Number)
+	}
+	return port
+}
+
+// overlaps returns whether both ports map a common protocol and port number.
+func (p Port) overlaps(other Port) bool {
+	return p.Protocol == other.Protocol && p.Number <= other.last() && other.Number <= p.last()
+}
+
+func (p Port) String() string {
+	var ports string
+	switch {
+	case p.isAll():
+		ports = "*"
+	case p.isRange():
+		ports = fmt.Sprintf("%d-%d", p.Number, p.last())
+	default:
+		ports = fmt.Sprint(p.Number)
+	}
+	if p.Target != 0 && p.Target != p.Number {
+		ports = fmt.Sprintf("%s->%d", ports, p.Target)
+	}
+	return fmt.Sprintf("%s/%s", ports, p.Protocol)
+}
+
 type HostMapping struct {
 	Host  string
-	Ports []uint16
+	Ports []Port
+	// Subnet is set when Host is a CIDR that is mapped one-to-one onto a slice of the mapping prefix.
+	Subnet netip.Prefix
+	// Address is an explicitly configured mapped address, if any. For subnets it is the first mapped address.
+	Address netip.Addr
+	// Order is the position of the mapped address in the mapping prefix, assigned by the allocator.
+	Order int
+	// Name, Kind and Labels are descriptive, set from the mapping file. Kind is the type of service,
+	// such as gitlab or jira, it is guessed from Host when not set.
+	Name   string
+	Kind   string
+	Labels map[string]string
+	// Wildcard is the wildcard entry an on-demand mapping was created for.
+	Wildcard string
+	// Backends are the targets of a load balanced mapping. Every address they resolve to is used.
+	Backends []string
+	// Balance is set for load balanced mappings, which use every address of Host when there are no Backends.
+	Balance     Balance
+	HealthCheck HealthCheck
+	// TLS is set when the agent connects to the backend over TLS, its TCP ports are served by a proxy.
+	TLS *TLSOrigination
+	// Routing is set for mappings that share a mapped address between the backends of Routes, picked
+	// per connection by a proxy. Host itself is only a name for the mapped address.
+	Routing Routing
+	Routes  []Route
+	// Proxy overrides the upstream proxy for the backends of the mapping, "direct" bypasses it.
+	Proxy string
+	// activity tracks the use of on-demand mappings, it is nil for configured ones.
+	activity *activity
 }
 
-func SetupFromConfig(s *stack.Stack, sendToServer bool) {
-	hostsMapping, err := parseHostsMapping(viper.GetString("Mapping.Hosts"))
+// blockSize returns the number of mapped addresses the mapping takes.
+func (m HostMapping) blockSize() int {
+	if !m.Subnet.IsValid() {
+		return 1
+	}
+	return 1 << (m.Subnet.Addr().BitLen() - m.Subnet.Bits())
+}
+
+// mappedSubnet returns the slice of prefix a subnet mapping is mapped onto.
+func (m HostMapping) mappedSubnet(prefix netip.Prefix) (netip.Prefix, error) {
+	addr, err := mappedAddr(prefix, m.Order)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	return netip.PrefixFrom(addr, m.Subnet.Bits()-m.Subnet.Addr().BitLen()+addr.BitLen()), nil
+}
+
+// config is a validated mapping configuration.
+type config struct {
+	hosts     []HostMapping
+	prefix    netip.Prefix
+	prefix6   netip.Prefix
+	overrides map[string][]net.IP
+	reverse   []Reverse
+}
+
+// ReloadedKeys are the settings a reload reads again, the others only take effect on restart.
+var ReloadedKeys = []string{"Mapping.Hosts", "Mapping.File", "Mapping.Prefix", "Mapping.Prefix6", "Mapping.Overrides", "Mapping.Reverse"}
+
+// reloaded holds the values of ReloadedKeys applied by the last reload. Viper is not safe for concurrent use,
+// so a reload never writes to it; the new values are read elsewhere and kept here instead.
+var reloaded struct {
+	lock   sync.Mutex
+	values map[string]string
+}
+
+// setting returns the value of a reloaded key, as of the last reload or else as configured on startup.
+func setting(key string) string {
+	reloaded.lock.Lock()
+	defer reloaded.lock.Unlock()
+
+	if value, ok := reloaded.values[key]; ok {
+		return value
+	}
+	return viper.GetString(key)
+}
+
+// loadConfig reads and validates the mapping configuration, getting the values of ReloadedKeys from get.
+func loadConfig(get func(key string) string) (config, error) {
+	hostsMapping, err := loadHostsMapping(get)
+	if err != nil {
+		return config{}, prefixErrors("error parsing hosts mapping", err)
+	}
+
+	mappingPrefix, mappingPrefix6, err := prefixesFromConfig(get)
+	if err != nil {
+		return config{}, fmt.Errorf("invalid mapping prefix: %w", err)
+	}
+
+	overrides, err := parseOverrides(get("Mapping.Overrides"))
 	if err != nil {
-		log.Fatalln("Error parsing hosts mapping", err)
+		return config{}, fmt.Errorf("error parsing overrides: %w", err)
 	}
 
-	for _, mapping := range hostsMapping {
-		log.Printf("Host: %s, Ports: %v\n", mapping.Host, mapping.Ports)
+	reverse, err := parseReverse(get("Mapping.Reverse"))
+	if err != nil {
+		return config{}, fmt.Errorf("error parsing reverse mapping: %w", err)
 	}
 
-	mappingPrefix := viper.GetString("Mapping.Prefix") + "."
+	return config{hosts: hostsMapping, prefix: mappingPrefix, prefix6: mappingPrefix6, overrides: overrides, reverse: reverse}, nil
+}
 
-	if net.ParseIP(mappingPrefix+"0") == nil {
-		log.Fatalln("Invalid mapping prefix", mappingPrefix)
+// SetupFromConfig maps the configured hosts and starts the reverse mappings. The configuration must be valid. With sendToServer, the
+// manifest is sent to the server now and whenever the effective mapping changes.
+func SetupFromConfig(s *stack.Stack, sendToServer bool) {
+	cfg, err := loadConfig(setting)
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	current.lock.Lock()
+	defer current.lock.Unlock()
+
+	current.sendToServer = sendToServer
+	setOverrides(cfg.overrides)
+	err = applyConfig(s, cfg)
+	if err != nil {
+		log.Fatalln("Error assigning mapped addresses", err)
+	}
+	err = applyReverse(s, cfg.reverse)
+	if err != nil {
+		log.Fatalln("Error starting reverse mappings", err)
 	}
+}
 
-	if sendToServer {
-		SendConfig(hostsMapping, mappingPrefix)
+// Refresh maps the last applied configuration again, picking up DNS changes of the hosts.
+// Only hosts whose lookup expired are resolved again.
+func Refresh(s *stack.Stack) {
+	// Hosts are resolved before taking the lock, so that slow lookups hold up neither DNS answers nor
+	// on-demand mappings. Setting up then finds their addresses cached.
+	current.lock.Lock()
+	var hosts []string
+	for _, mapping := range current.hosts {
+		if !mapping.Subnet.IsValid() {
+			hosts = append(hosts, mapping.BackendHosts()...)
+		}
 	}
+	current.lock.Unlock()
+	resolveAll(hosts)
 
-	setup(s, mappingPrefix, hostsMapping)
+	current.lock.Lock()
+	defer current.lock.Unlock()
+
+	err := applyConfig(s, current.config)
+	if err != nil {
+		log.Println("Error refreshing mapping", err)
+	}
 }
 
-// HOSTS: "a.com:80:443,b.com:123,10.4.1.2:80:8080:81,h.com,x.com:123"
-func parseHostsMapping(input string) ([]HostMapping, error) {
-	var result []HostMapping
+// Reload reads the mapping configuration again and applies it. The current mapping is kept when the new
+// configuration is invalid or its reverse mappings cannot listen; established connections survive either way.
+// ReloadedKeys are read from settings, a viper instance of the reloaded config file, or are kept as they are
+// when settings is nil.
+func Reload(s *stack.Stack, settings *viper.Viper) error {
+	get := setting
+	var values map[string]string
+	if settings != nil {
+		values = make(map[string]string)
+		for _, key := range ReloadedKeys {
+			values[key] = settings.GetString(key)
+		}
+		get = func(key string) string { return values[key] }
+	}
 
-	// iterate over host-port pairs
-	for _, mapping := range strings.Split(input, ",") {
+	cfg, err := loadConfig(get)
+	if err != nil {
+		return err
+	}
 
-		// Remove leading or trailing spaces
-		mapping = strings.TrimSpace(mapping)
+	current.lock.Lock()
+	defer current.lock.Unlock()
 
-		if len(mapping) == 0 {
-			continue
+	// Hosts whose override changed are resolved again.
+	previous := current.config
+	setOverrides(cfg.overrides)
+	err = applyConfig(s, cfg)
+	if err != nil {
+		setOverrides(previous.overrides)
+		return err
+	}
+	err = applyReverse(s, cfg.reverse)
+	if err != nil {
+		// A reload applies entirely or not at all, so the previous mapping and its reverse mappings come back.
+		setOverrides(previous.overrides)
+		if rollbackErr := applyConfig(s, previous); rollbackErr != nil {
+			log.Println("Error restoring mapping", rollbackErr)
+		}
+		if rollbackErr := applyReverse(s, previous.reverse); rollbackErr != nil {
+			log.Println("Error restoring reverse mappings", rollbackErr)
+		}
+		return err
+	}
+
+	if values != nil {
+		reloaded.lock.Lock()
+		reloaded.values = values
+		reloaded.lock.Unlock()
+	}
+	return nil
+}
+
+// RefreshLoop refreshes the mapping whenever a resolved host expires, following the TTLs of its records,
+// and when a failed lookup is due to be retried.
+func RefreshLoop(s *stack.Stack) {
+	for {
+		timer := time.NewTimer(time.Until(nextResolution()))
+		select {
+		case <-timer.C:
+			Refresh(s)
+		case <-resolutions.wake:
+			timer.Stop()
+		}
+	}
+}
+
+// applyConfig assigns mapped addresses to a configuration and sets it up. Nothing changes when assignment fails.
+// The caller holds current.lock.
+func applyConfig(s *stack.Stack, cfg config) error {
+	// Wildcard entries are not mapped themselves, names under them are mapped on demand.
+	hostsMapping, wildcards := splitWildcards(cfg.hosts)
+	onDemandMappings := keptOnDemand(wildcards)
+	hostsMapping = append(hostsMapping, onDemandMappings...)
+
+	err := allocations.assign(hostsMapping, cfg.prefix, cfg.prefix6)
+	if err != nil {
+		return err
+	}
+	setOnDemand(wildcards, onDemandMappings)
+
+	// Refreshes apply the same assignment again and again, it is only logged when it changes.
+	assignment := assignmentSummary(hostsMapping, wildcards, cfg.prefix, cfg.prefix6)
+	assigned := assignment != current.assignment
+	if assigned {
+		log.Println("Mapping IPs", cfg.prefix)
+		if cfg.prefix6.IsValid() {
+			log.Println("Mapping IPv6 IPs", cfg.prefix6)
 		}
+		for _, mapping := range hostsMapping {
+			log.Printf("Host: %s, Ports: %v, Order: %d\n", mapping.Host, mapping.Ports, mapping.Order)
+		}
+		for _, wildcard := range wildcards {
+			log.Printf("Wildcard: %s, Ports: %v\n", wildcard.Host, wildcard.Ports)
+		}
+	}
+
+	installed := setup(s, cfg.prefix, cfg.prefix6, hostsMapping)
+	current.config = cfg
+	current.assignment = assignment
+
+	// Sent after setup, so that the manifest reports how the hosts resolved. It is only built again when the
+	// assignment, the installed rules or the resolution of a host changed.
+	resolved := resolutionSummary(hostsMapping)
+	if current.sendToServer && (assigned || installed || resolved != current.resolved) {
+		SendConfig(hostsMapping, cfg.prefix, cfg.prefix6)
+	}
+	current.resolved = resolved
+	return nil
+}
+
+// assignmentSummary describes the mapped hosts, ports and orders of a configuration.
+func assignmentSummary(hostMappings []HostMapping, wildcards []HostMapping, prefix netip.Prefix, prefix6 netip.Prefix) string {
+	var b strings.Builder
+	fmt.Fprintln(&b, prefix, prefix6)
+	for _, mapping := range hostMappings {
+		fmt.Fprintln(&b, mapping.Host, mapping.Ports, mapping.Order)
+	}
+	for _, wildcard := range wildcards {
+		fmt.Fprintln(&b, wildcard.Host, wildcard.Ports)
+	}
+	return b.String()
+}
+
+// resolutionSummary describes how the hosts of mappings resolved. Errors are left out, as in the revision of the manifest.
+func resolutionSummary(hostMappings []HostMapping) string {
+	var b strings.Builder
+	for _, mapping := range hostMappings {
+		state, addresses, _ := hostResolution(mapping)
+		fmt.Fprintln(&b, mapping.Host, state, addresses)
+	}
+	return b.String()
+}
+
+// target is a resolved mapping: the mapped address peers connect to and the backend it is translated to.
+// Subnet mappings translate the host bits of the mapped address onto the backend subnet.
+type target struct {
+	mapped  tcpip.Address
+	backend tcpip.Address
+	bits    int
+	ports   []Port
+	// activity records new connections of on-demand mappings.
+	activity *activity
+	// pool holds the backends of load balanced mappings, which have no single backend.
+	pool *backendPool
+	// proxies serve the TCP ports, by number, that are not translated to the backend.
+	proxies map[uint16]*proxy
+}
 
-		parts := strings.Split(mapping, ":")
+// setupState is the last applied setup. On-demand mappings are added to it between setups.
+type setupState struct {
+	lock         sync.Mutex
+	config       config
+	sendToServer bool
+	s            *stack.Stack
+	prefix       netip.Prefix
+	prefix6      netip.Prefix
+	hosts        []HostMapping
+	targets4     []target
+	targets6     []target
+	names        *nameTable
+	// assignment and resolved summarize the last applied configuration, to tell refreshes that change nothing.
+	assignment string
+	resolved   string
+}
+
+var current setupState
+
+// setup resolves the mappings and installs them. It returns whether the NAT rules changed.
+func setup(s *stack.Stack, mappingPrefix netip.Prefix, mappingPrefix6 netip.Prefix, hostMappings []HostMapping) bool {
+	// Hosts that are no longer mapped are forgotten by the resolver.
+	sweepResolutions()
+
+	// Proxies of the mappings listen on the stack.
+	current.s = s
+
+	var targets4, targets6 []target
+	names := newNameTable()
+	for _, mapping := range hostMappings {
+		mappingTargets4, mappingTargets6 := mappingTargets(mapping, mappingPrefix, mappingPrefix6, names)
+		targets4 = append(targets4, mappingTargets4...)
+		targets6 = append(targets6, mappingTargets6...)
+	}
+
+	all := append(append([]target(nil), targets4...), targets6...)
+	retainPools(all)
+	retainProxies(all)
+
+	current.prefix = mappingPrefix
+	current.prefix6 = mappingPrefix6
+	current.hosts = hostMappings
+	current.targets4 = targets4
+	current.targets6 = targets6
+	current.names = names
+	return current.apply()
+}
+
+// apply publishes the backends of the current mappings to the upstream dialer, installs their NAT table,
+// then publishes their names. It returns whether the NAT rules changed.
+func (c *setupState) apply() bool {
+	upstream.SetDestinations(destinations(c.hosts))
+
+	changed := setupNATMasquarade(c.s, ipv4.ProtocolNumber, c.targets4)
+	if c.prefix6.IsValid() {
+		changed = setupNATMasquarade(c.s, ipv6.ProtocolNumber, c.targets6) || changed
+	}
 
-		host := parts[0]
-		var ports []uint16
+	dnsNames.set(c.names)
+	return changed
+}
 
-		if len(parts[1:]) > 0 {
-			for _, port := range parts[1:] {
-				// Parse string to uint
-				portUint, err := strconv.ParseUint(port, 10, 16)
-				if err != nil {
-					return nil, fmt.Errorf("invalid port value '%s': %w", port, err)
+// destinations returns the resolved backend addresses of mappings, with the host they were resolved from and
+// the proxy of their mapping. An address shared by several hosts keeps the first.
+func destinations(hosts []HostMapping) map[netip.Addr]upstream.Destination {
+	result := make(map[netip.Addr]upstream.Destination)
+	for _, mapping := range hosts {
+		if mapping.Subnet.IsValid() {
+			continue
+		}
+		for _, host := range mapping.BackendHosts() {
+			state, ips, _ := resolutionOf(host)
+			pinned := pinnedResolution(mapping, state)
+			for _, ip := range ips {
+				addr, ok := netip.AddrFromSlice(ip)
+				if !ok {
+					continue
+				}
+				if _, found := result[addr.Unmap()]; !found {
+					result[addr.Unmap()] = upstream.Destination{Host: host, Proxy: mapping.Proxy, Pinned: pinned}
 				}
-				ports = append(ports, uint16(portUint))
 			}
-		} else {
-			// Use default ports if none are provided
-			ports = []uint16{80, 443}
 		}
-
-		result = append(result, HostMapping{
-			Host:  host,
-			Ports: ports,
-		})
 	}
+	return result
+}
 
-	return result, nil
+// pinnedResolution returns whether the backends of a mapping resolved in a state must be dialed at their
+// address: backends of pools are dialed at the address picked, overridden hosts at their override.
+func pinnedResolution(mapping HostMapping, state string) bool {
+	return mapping.Balance != "" || state == resolutionOverride
 }
 
-func setup(s *stack.Stack, mappingPrefix string, hostMappings []HostMapping) {
-	log.Println("Mapping IPs", mappingPrefix)
-	setupNATMasquarade(
-		s,
-		ipv4.ProtocolNumber,
-		mappingPrefix,
-		hostMappings,
-	)
+// mappingTargets resolves a mapping into its IPv4 and IPv6 targets and adds its mapped addresses to names.
+// The caller holds current.lock.
+func mappingTargets(mapping HostMapping, mappingPrefix netip.Prefix, mappingPrefix6 netip.Prefix, names *nameTable) ([]target, []target) {
+	targets4, targets6 := resolveTargets(mapping, mappingPrefix, mappingPrefix6, names)
+	proxyTargets(mapping, targets4, ipv4.ProtocolNumber)
+	proxyTargets(mapping, targets6, ipv6.ProtocolNumber)
+	return targets4, targets6
 }
 
-func setupNATMasquarade(s *stack.Stack, netProto tcpip.NetworkProtocolNumber, mappingPrefix string, hostMappings []HostMapping) {
+func resolveTargets(mapping HostMapping, mappingPrefix netip.Prefix, mappingPrefix6 netip.Prefix, names *nameTable) ([]target, []target) {
+	if mapping.Balance != "" {
+		return balancedTargets(mapping, mappingPrefix, mappingPrefix6, names)
+	}
+	if mapping.Routing != "" {
+		return routedTargets(mapping, mappingPrefix, mappingPrefix6, names)
+	}
 
-	ipv6 := netProto == ipv6.ProtocolNumber
-	ipt := s.IPTables()
+	var targets4, targets6 []target
+	if mapping.Subnet.IsValid() {
+		prefix := mappingPrefix
+		if mapping.Subnet.Addr().Is6() {
+			prefix = mappingPrefix6
+		}
+		if !prefix.IsValid() {
+			log.Println("Subnet is IPv6 but no IPv6 mapping prefix is configured", mapping.Host)
+			return nil, nil
+		}
 
-	dstMask := net.ParseIP("255.255.255.255").To4()
-	rules := make([]stack.Rule, 0)
+		mappedSubnet, err := mapping.mappedSubnet(prefix)
+		if err != nil {
+			log.Println("Unable to map subnet", mapping.Host, err)
+			return nil, nil
+		}
 
-	for i, mapping := range hostMappings {
-		mappedIp, err := resolveIP(mapping.Host)
+		t := target{
+			mapped:  tcpip.AddrFromSlice(mappedSubnet.Addr().AsSlice()),
+			backend: tcpip.AddrFromSlice(mapping.Subnet.Addr().AsSlice()),
+			bits:    mapping.Subnet.Bits(),
+			ports:   mapping.Ports,
+		}
+		if mapping.Subnet.Addr().Is6() {
+			return nil, []target{t}
+		}
+		return []target{t}, nil
+	}
 
+	ip4, ip6, err := resolveIP(mapping.Host)
+	if err != nil {
+		return nil, nil
+	}
+
+	if ip4 != nil {
+		mappedIp, err := mappedAddr(mappingPrefix, mapping.Order)
 		if err != nil {
-			continue
+			log.Println("Unable to map IP", mapping.Host, err)
+		} else {
+			targets4 = append(targets4, target{
+				mapped:   tcpip.AddrFrom4(mappedIp.As4()),
+				backend:  tcpip.AddrFrom4Slice(ip4),
+				bits:     32,
+				ports:    mapping.Ports,
+				activity: mapping.activity,
+			})
+			names.add(mapping.Host, mappedIp)
+		}
+	}
+
+	if ip6 != nil {
+		if !mappingPrefix6.IsValid() {
+			if ip4 == nil {
+				log.Println("Host resolves only to IPv6 but no IPv6 mapping prefix is configured", mapping.Host)
+			}
+			return targets4, nil
 		}
 
-		for _, port := range mapping.Ports {
+		mappedIp6, err := mappedAddr(mappingPrefix6, mapping.Order)
+		if err != nil {
+			log.Println("Unable to map IPv6", mapping.Host, err)
+		} else {
+			targets6 = append(targets6, target{
+				mapped:   tcpip.AddrFrom16(mappedIp6.As16()),
+				backend:  tcpip.AddrFrom16Slice(ip6),
+				bits:     128,
+				ports:    mapping.Ports,
+				activity: mapping.activity,
+			})
+			names.add(mapping.Host, mappedIp6)
+		}
+	}
+	return targets4, targets6
+}
+
+// setupNATMasquarade installs the NAT table of targets and returns whether its rules changed.
+func setupNATMasquarade(s *stack.Stack, netProto tcpip.NetworkProtocolNumber, targets []target) bool {
+	// Replacing the table is only needed when its rules change.
+	if !updateInstalled(s, netProto, targets) {
+		return false
+	}
+
+	ipv6 := netProto == ipv6.ProtocolNumber
+	ipt := s.IPTables()
+
+	// Services of the agent itself come first, so mappings cannot shadow them.
+	rules := localRules(netProto)
+
+	for _, t := range targets {
+		dstMask := tcpip.AddrFromSlice(net.CIDRMask(t.bits, t.mapped.BitLen()))
+		for _, port := range t.ports {
 			rule := stack.Rule{
 				Filter: stack.IPHeaderFilter{
 					CheckProtocol: false,
-					Dst:           tcpip.AddrFrom4Slice(net.ParseIP(mappingPrefix + strconv.Itoa(i+1)).To4()),
-					DstMask:       tcpip.AddrFrom4Slice(dstMask),
-				},
-				Target: &stack.DNATTarget{
-					NetworkProtocol: ipv4.ProtocolNumber,
-					Addr:            tcpip.AddrFrom4Slice(mappedIp.To4()),
-					Port:            port,
+					Dst:           t.mapped,
+					DstMask:       dstMask,
 				},
+				Target: natTarget(netProto, t, port),
 				Matchers: []stack.Matcher{
-					&TCPMatcher{
-						destinationPort: port,
-					},
+					portMatcher(port),
 				},
 			}
+			if t.activity != nil {
+				rule.Matchers = append(rule.Matchers, &activityMatcher{activity: t.activity})
+			}
 
 			rules = append(rules, rule)
 		}
@@ -172,72 +640,5 @@ func setupNATMasquarade(s *stack.Stack, netProto tcpip.NetworkProtocolNumber, ma
 	}
 
 	ipt.ReplaceTable(stack.NATID, table, ipv6)
-}
-
-func resolveIP(host string) (net.IP, error) {
-	ip := net.ParseIP(host)
-	if ip == nil {
-		// Hostname is not in IP format, resolve it
-		resolvedIP, err := net.ResolveIPAddr("ip4", host)
-		if err != nil {
-			log.Println("Unable to resolve IP", host, err.Error())
-			return nil, err
-		} else {
-			if viper.GetBool("verbose") {
-				log.Println("Resolved IP", host, resolvedIP.IP)
-			}
-			return resolvedIP.IP, nil
-		}
-	} else {
-		// Hostname is already an IP address
-		return ip, nil
-	}
-}
-
-type TCPMatcher struct {
-	destinationPort uint16
-}
-
-func (tm *TCPMatcher) Match(hook stack.Hook, pkt stack.PacketBufferPtr, _, _ string) (bool, bool) {
-	switch pkt.NetworkProtocolNumber {
-	case header.IPv4ProtocolNumber:
-		netHeader := header.IPv4(pkt.NetworkHeader().Slice())
-		if netHeader.TransportProtocol() != header.TCPProtocolNumber {
-			return false, false
-		}
-
-		// We don't match fragments.
-		if frag := netHeader.FragmentOffset(); frag != 0 {
-			if frag == 1 {
-				return false, true
-			}
-			return false, false
-		}
-
-	case header.IPv6ProtocolNumber:
-		// As in Linux, we do not perform an IPv6 fragment check. See
-		// xt_action_param.fragoff in
-		// include/linux/netfilter/x_tables.h.
-		if header.IPv6(pkt.NetworkHeader().Slice()).TransportProtocol() != header.TCPProtocolNumber {
-			return false, false
-		}
-
-	default:
-		// We don't know the network protocol.
-		return false, false
-	}
-
-	tcpHeader := header.TCP(pkt.TransportHeader().Slice())
-	if len(tcpHeader) < header.TCPMinimumSize {
-		// There's no valid TCP header here, so we drop the packet immediately.
-		return false, true
-	}
-
-	// Check whether the source and destination ports are within the
-	// matching range.
-	if destinationPort := tcpHeader.DestinationPort(); destinationPort != tm.destinationPort {
-		return false, false
-	}
-
-	return true, false
+	return true
 }
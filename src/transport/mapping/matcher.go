@@ -0,0 +1,187 @@
+package mapping
+
+import (
+	"net"
+
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+)
+
+// portMatcher returns the matcher for the transport protocol and port range of port.
+func portMatcher(port Port) stack.Matcher {
+	if port.Protocol == ProtocolUDP {
+		return &UDPMatcher{destinationPortStart: port.Number, destinationPortEnd: port.last()}
+	}
+	return &TCPMatcher{destinationPortStart: port.Number, destinationPortEnd: port.last()}
+}
+
+// natTarget returns the target of the rule of a mapped port.
+func natTarget(netProto tcpip.NetworkProtocolNumber, t target, port Port) stack.Target {
+	if p, ok := t.proxies[port.Number]; ok && port.Protocol == ProtocolTCP {
+		return &stack.DNATTarget{NetworkProtocol: netProto, Addr: p.local.Addr, Port: p.local.Port}
+	}
+	if t.pool != nil {
+		return &balanceTarget{pool: t.pool, port: port, netProto: netProto}
+	}
+	return dnatTarget(netProto, t.backend, t.bits, port)
+}
+
+// dnatTarget returns the DNAT target for port. Port ranges and subnets are translated per packet by mapTarget.
+func dnatTarget(netProto tcpip.NetworkProtocolNumber, backend tcpip.Address, bits int, port Port) stack.Target {
+	if port.isRange() || bits != backend.BitLen() {
+		return &mapTarget{
+			addr:     backend,
+			mask:     net.CIDRMask(bits, backend.BitLen()),
+			port:     port,
+			netProto: netProto,
+		}
+	}
+
+	return &stack.DNATTarget{
+		NetworkProtocol: netProto,
+		Addr:            backend,
+		Port:            port.backendPort(port.Number),
+	}
+}
+
+// mapTarget translates a range of mapped ports to backend ports, preserving the offset within the range,
+// and the host bits of the mapped address onto the backend subnet (NETMAP).
+type mapTarget struct {
+	addr     tcpip.Address
+	mask     net.IPMask
+	port     Port
+	netProto tcpip.NetworkProtocolNumber
+}
+
+// Action implements stack.Target.Action.
+func (mt *mapTarget) Action(pkt stack.PacketBufferPtr, hook stack.Hook, r *stack.Route, addressEP stack.AddressableEndpoint) (stack.RuleVerdict, int) {
+	destinationPort, ok := destinationPort(pkt)
+	if !ok {
+		return stack.RuleDrop, 0
+	}
+
+	// Keep the host bits of the destination, take the network bits from the backend.
+	destinationAddr := pkt.Network().DestinationAddress()
+	destination := destinationAddr.AsSlice()
+	backend := mt.addr.AsSlice()
+	addr := make([]byte, len(backend))
+	for i := range addr {
+		addr[i] = backend[i]&mt.mask[i] | destination[i]&^mt.mask[i]
+	}
+
+	target := stack.DNATTarget{
+		NetworkProtocol: mt.netProto,
+		Addr:            tcpip.AddrFromSlice(addr),
+		Port:            mt.port.backendPort(destinationPort),
+	}
+	return target.Action(pkt, hook, r, addressEP)
+}
+
+// destinationPort returns the destination port of a TCP or UDP packet.
+func destinationPort(pkt stack.PacketBufferPtr) (uint16, bool) {
+	switch pkt.TransportProtocolNumber {
+	case header.TCPProtocolNumber:
+		return header.TCP(pkt.TransportHeader().Slice()).DestinationPort(), true
+	case header.UDPProtocolNumber:
+		return header.UDP(pkt.TransportHeader().Slice()).DestinationPort(), true
+	}
+	return 0, false
+}
+
+type TCPMatcher struct {
+	destinationPortStart uint16
+	destinationPortEnd   uint16
+}
+
+func (tm *TCPMatcher) Match(hook stack.Hook, pkt stack.PacketBufferPtr, _, _ string) (bool, bool) {
+	switch pkt.NetworkProtocolNumber {
+	case header.IPv4ProtocolNumber:
+		netHeader := header.IPv4(pkt.NetworkHeader().Slice())
+		if netHeader.TransportProtocol() != header.TCPProtocolNumber {
+			return false, false
+		}
+
+		// We don't match fragments.
+		if frag := netHeader.FragmentOffset(); frag != 0 {
+			if frag == 1 {
+				return false, true
+			}
+			return false, false
+		}
+
+	case header.IPv6ProtocolNumber:
+		// As in Linux, we do not perform an IPv6 fragment check. See
+		// xt_action_param.fragoff in
+		// include/linux/netfilter/x_tables.h.
+		if header.IPv6(pkt.NetworkHeader().Slice()).TransportProtocol() != header.TCPProtocolNumber {
+			return false, false
+		}
+
+	default:
+		// We don't know the network protocol.
+		return false, false
+	}
+
+	tcpHeader := header.TCP(pkt.TransportHeader().Slice())
+	if len(tcpHeader) < header.TCPMinimumSize {
+		// There's no valid TCP header here, so we drop the packet immediately.
+		return false, true
+	}
+
+	// Check whether the source and destination ports are within the
+	// matching range.
+	if destinationPort := tcpHeader.DestinationPort(); destinationPort < tm.destinationPortStart || destinationPort > tm.destinationPortEnd {
+		return false, false
+	}
+
+	return true, false
+}
+
+type UDPMatcher struct {
+	destinationPortStart uint16
+	destinationPortEnd   uint16
+}
+
+func (um *UDPMatcher) Match(hook stack.Hook, pkt stack.PacketBufferPtr, _, _ string) (bool, bool) {
+	switch pkt.NetworkProtocolNumber {
+	case header.IPv4ProtocolNumber:
+		netHeader := header.IPv4(pkt.NetworkHeader().Slice())
+		if netHeader.TransportProtocol() != header.UDPProtocolNumber {
+			return false, false
+		}
+
+		// We don't match fragments.
+		if frag := netHeader.FragmentOffset(); frag != 0 {
+			if frag == 1 {
+				return false, true
+			}
+			return false, false
+		}
+
+	case header.IPv6ProtocolNumber:
+		// As in Linux, we do not perform an IPv6 fragment check. See
+		// xt_action_param.fragoff in
+		// include/linux/netfilter/x_tables.h.
+		if header.IPv6(pkt.NetworkHeader().Slice()).TransportProtocol() != header.UDPProtocolNumber {
+			return false, false
+		}
+
+	default:
+		// We don't know the network protocol.
+		return false, false
+	}
+
+	udpHeader := header.UDP(pkt.TransportHeader().Slice())
+	if len(udpHeader) < header.UDPMinimumSize {
+		// There's no valid UDP header here, so we drop the packet immediately.
+		return false, true
+	}
+
+	// Check whether the destination port is within the matching range.
+	if destinationPort := udpHeader.DestinationPort(); destinationPort < um.destinationPortStart || destinationPort > um.destinationPortEnd {
+		return false, false
+	}
+
+	return true, false
+}
@@ -0,0 +1,160 @@
+package mapping
+
+import (
+	"fmt"
+	"net/netip"
+	"testing"
+
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv4"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+)
+
+func TestDNATTarget(t *testing.T) {
+	backend := tcpip.AddrFrom4(netip.MustParseAddr("10.4.1.2").As4())
+
+	tests := []struct {
+		port     string
+		bits     int
+		wantPort uint16
+		// perPacket targets translate every packet, the port is found from its destination port.
+		perPacket bool
+	}{
+		{port: "443", bits: 32, wantPort: 443},
+		{port: "80->8080", bits: 32, wantPort: 8080},
+		{port: "53->5353/udp", bits: 32, wantPort: 5353},
+		{port: "5900-5999", bits: 32, perPacket: true},
+		{port: "8000-8010->9000", bits: 32, perPacket: true},
+		{port: "22", bits: 26, perPacket: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.port, func(t *testing.T) {
+			port, err := parsePort(test.port)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if test.perPacket {
+				target, ok := dnatTarget(ipv4.ProtocolNumber, backend, test.bits, port).(*mapTarget)
+				if !ok {
+					t.Fatalf("dnatTarget(%s) is not a per-packet target", port)
+				}
+				if target.addr != backend || target.port != port {
+					t.Errorf("dnatTarget(%s) = %s %s, want %s %s", port, target.addr, target.port, backend, port)
+				}
+				return
+			}
+
+			target, ok := dnatTarget(ipv4.ProtocolNumber, backend, test.bits, port).(*stack.DNATTarget)
+			if !ok {
+				t.Fatalf("dnatTarget(%s) is not a DNAT target", port)
+			}
+			if target.Addr != backend || target.Port != test.wantPort {
+				t.Errorf("dnatTarget(%s) = %s:%d, want %s:%d", port, target.Addr, target.Port, backend, test.wantPort)
+			}
+		})
+	}
+}
+
+func TestBackendPort(t *testing.T) {
+	tests := []struct {
+		port   string
+		mapped uint16
+		want   uint16
+	}{
+		{port: "443", mapped: 443, want: 443},
+		{port: "80->8080", mapped: 80, want: 8080},
+		{port: "5900-5999", mapped: 5950, want: 5950},
+		{port: "8000-8010->9000", mapped: 8000, want: 9000},
+		{port: "8000-8010->9000", mapped: 8010, want: 9010},
+		{port: "*", mapped: 65535, want: 65535},
+	}
+
+	for _, test := range tests {
+		t.Run(fmt.Sprintf("%s %d", test.port, test.mapped), func(t *testing.T) {
+			port, err := parsePort(test.port)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := port.backendPort(test.mapped); got != test.want {
+				t.Errorf("backendPort(%d) of %s = %d, want %d", test.mapped, port, got, test.want)
+			}
+		})
+	}
+}
+
+func TestPortMatcher(t *testing.T) {
+	tests := []struct {
+		port      string
+		wantUDP   bool
+		wantStart uint16
+		wantEnd   uint16
+	}{
+		{port: "443", wantStart: 443, wantEnd: 443},
+		{port: "80->8080", wantStart: 80, wantEnd: 80},
+		{port: "53/udp", wantUDP: true, wantStart: 53, wantEnd: 53},
+		{port: "5900-5999", wantStart: 5900, wantEnd: 5999},
+		{port: "*/udp", wantUDP: true, wantStart: 1, wantEnd: 65535},
+	}
+
+	for _, test := range tests {
+		t.Run(test.port, func(t *testing.T) {
+			port, err := parsePort(test.port)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var start, end uint16
+			switch matcher := portMatcher(port).(type) {
+			case *TCPMatcher:
+				if test.wantUDP {
+					t.Fatalf("portMatcher(%s) matches TCP", port)
+				}
+				start, end = matcher.destinationPortStart, matcher.destinationPortEnd
+			case *UDPMatcher:
+				if !test.wantUDP {
+					t.Fatalf("portMatcher(%s) matches UDP", port)
+				}
+				start, end = matcher.destinationPortStart, matcher.destinationPortEnd
+			default:
+				t.Fatalf("portMatcher(%s) = %T", port, matcher)
+			}
+			if start != test.wantStart || end != test.wantEnd {
+				t.Errorf("portMatcher(%s) matches %d-%d, want %d-%d", port, start, end, test.wantStart, test.wantEnd)
+			}
+		})
+	}
+}
+
+func TestPortOverlaps(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want bool
+	}{
+		{a: "80", b: "80", want: true},
+		{a: "80", b: "80/udp", want: false},
+		{a: "80", b: "80->8080", want: true},
+		{a: "5900-5999", b: "5999", want: true},
+		{a: "5900-5999", b: "6000-6100", want: false},
+		{a: "5900-5999", b: "5000-5900", want: true},
+		{a: "*", b: "22", want: true},
+		{a: "*/udp", b: "22", want: false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.a+" "+test.b, func(t *testing.T) {
+			a, err := parsePort(test.a)
+			if err != nil {
+				t.Fatal(err)
+			}
+			b, err := parsePort(test.b)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if a.overlaps(b) != test.want || b.overlaps(a) != test.want {
+				t.Errorf("%s overlaps %s = %v, want %v", a, b, a.overlaps(b), test.want)
+			}
+		})
+	}
+}
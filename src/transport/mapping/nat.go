@@ -0,0 +1,127 @@
+package mapping
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+
+	"github.com/spf13/viper"
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv6"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+)
+
+// installedTable describes the NAT table installed for a network protocol.
+type installedTable struct {
+	s       *stack.Stack
+	targets map[string]target
+	locals  string
+}
+
+// installedTables lets setups replace a NAT table only when its rules change. Connections established
+// before a change keep their translation through connection tracking, so connections to a removed or
+// changed backend drain instead of breaking.
+var installedTables = struct {
+	lock   sync.Mutex
+	tables map[tcpip.NetworkProtocolNumber]installedTable
+}{tables: make(map[tcpip.NetworkProtocolNumber]installedTable)}
+
+// key identifies the rules of a target, apart from the backend they translate to.
+func (t target) key() string {
+	return fmt.Sprintf("%s/%d %v", t.mapped, t.bits, t.ports)
+}
+
+func (t target) String() string {
+	backend := fmt.Sprintf("%s/%d", t.backend, t.bits)
+	if t.pool != nil {
+		backend = t.pool.String()
+	}
+	if t.backend.Len() == 0 && t.pool == nil {
+		backend = "routes"
+	}
+	if len(t.proxies) > 0 {
+		var proxied []uint16
+		for port := range t.proxies {
+			proxied = append(proxied, port)
+		}
+		sort.Slice(proxied, func(i, j int) bool { return proxied[i] < proxied[j] })
+		return fmt.Sprintf("%s/%d -> %s %v, proxied %v", t.mapped, t.bits, backend, t.ports, proxied)
+	}
+	return fmt.Sprintf("%s/%d -> %s %v", t.mapped, t.bits, backend, t.ports)
+}
+
+// sameProxies returns whether two targets are served by the same proxies.
+func sameProxies(a target, b target) bool {
+	if len(a.proxies) != len(b.proxies) {
+		return false
+	}
+	for port, p := range a.proxies {
+		if b.proxies[port] != p {
+			return false
+		}
+	}
+	return true
+}
+
+// updateInstalled records the targets of the NAT table of a network protocol and logs how they changed.
+// It returns whether the table must be replaced.
+func updateInstalled(s *stack.Stack, netProto tcpip.NetworkProtocolNumber, targets []target) bool {
+	installedTables.lock.Lock()
+	defer installedTables.lock.Unlock()
+
+	desired := installedTable{
+		s:       s,
+		targets: make(map[string]target, len(targets)),
+		locals:  localServicesKey(netProto),
+	}
+	for _, t := range targets {
+		desired.targets[t.key()] = t
+	}
+
+	family := "IPv4"
+	if netProto == ipv6.ProtocolNumber {
+		family = "IPv6"
+	}
+
+	previous, ok := installedTables.tables[netProto]
+	installedTables.tables[netProto] = desired
+	if !ok || previous.s != s {
+		log.Printf("Installing %s NAT table with %d mappings\n", family, len(targets))
+		return true
+	}
+
+	var changes []string
+	for key, t := range desired.targets {
+		old, found := previous.targets[key]
+		switch {
+		case !found:
+			changes = append(changes, fmt.Sprintf("added %s", t))
+		case old.backend != t.backend:
+			changes = append(changes, fmt.Sprintf("changed %s, was %s, established connections keep the old backend", t, old.backend))
+		case old.activity != t.activity || old.pool != t.pool || !sameProxies(old, t):
+			changes = append(changes, fmt.Sprintf("renewed %s", t))
+		}
+	}
+	for key, t := range previous.targets {
+		if _, found := desired.targets[key]; !found {
+			changes = append(changes, fmt.Sprintf("removed %s, established connections drain", t))
+		}
+	}
+	if desired.locals != previous.locals {
+		changes = append(changes, "local services changed")
+	}
+
+	if len(changes) == 0 {
+		if viper.GetBool("verbose") {
+			log.Printf("%s NAT table is up to date\n", family)
+		}
+		return false
+	}
+
+	sort.Strings(changes)
+	for _, change := range changes {
+		log.Printf("%s mapping %s\n", family, change)
+	}
+	return true
+}
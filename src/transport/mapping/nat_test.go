@@ -0,0 +1,119 @@
+package mapping
+
+import (
+	"net/netip"
+	"testing"
+
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv4"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv6"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+)
+
+func TestUpdateInstalled(t *testing.T) {
+	addr := func(value string) tcpip.Address {
+		return tcpip.AddrFromSlice(netip.MustParseAddr(value).AsSlice())
+	}
+	tcp := func(number uint16) Port { return Port{Number: number, Protocol: ProtocolTCP} }
+	to := func(mapped, backend string, ports ...Port) target {
+		return target{mapped: addr(mapped), backend: addr(backend), bits: 32, ports: ports}
+	}
+	a := to("10.1.0.1", "192.168.0.1", tcp(80), tcp(443))
+	b := to("10.1.0.2", "192.168.0.2", tcp(22))
+	onDemand := a
+	onDemand.activity = &activity{}
+	renewed := a
+	renewed.activity = &activity{}
+
+	s, other := new(stack.Stack), new(stack.Stack)
+
+	type step struct {
+		s       *stack.Stack
+		targets []target
+		want    bool
+	}
+	tests := []struct {
+		name  string
+		steps []step
+	}{
+		{
+			name:  "first setup",
+			steps: []step{{s: s, targets: []target{a}, want: true}},
+		},
+		{
+			name: "unchanged",
+			steps: []step{
+				{s: s, targets: []target{a, b}, want: true},
+				{s: s, targets: []target{a, b}, want: false},
+				{s: s, targets: []target{b, a}, want: false},
+			},
+		},
+		{
+			name: "changed backend",
+			steps: []step{
+				{s: s, targets: []target{a, b}, want: true},
+				{s: s, targets: []target{a, to("10.1.0.2", "192.168.0.9", tcp(22))}, want: true},
+				{s: s, targets: []target{a, to("10.1.0.2", "192.168.0.9", tcp(22))}, want: false},
+			},
+		},
+		{
+			name: "changed ports",
+			steps: []step{
+				{s: s, targets: []target{a, b}, want: true},
+				{s: s, targets: []target{a, to("10.1.0.2", "192.168.0.2", tcp(2222))}, want: true},
+			},
+		},
+		{
+			name: "added and removed",
+			steps: []step{
+				{s: s, targets: []target{a}, want: true},
+				{s: s, targets: []target{a, b}, want: true},
+				{s: s, targets: []target{b}, want: true},
+				{s: s, targets: nil, want: true},
+				{s: s, targets: nil, want: false},
+			},
+		},
+		{
+			name: "renewed on-demand mapping",
+			steps: []step{
+				{s: s, targets: []target{onDemand}, want: true},
+				{s: s, targets: []target{onDemand}, want: false},
+				{s: s, targets: []target{renewed}, want: true},
+			},
+		},
+		{
+			name: "other stack",
+			steps: []step{
+				{s: s, targets: []target{a}, want: true},
+				{s: other, targets: []target{a}, want: true},
+				{s: other, targets: []target{a}, want: false},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			installedTables.lock.Lock()
+			installedTables.tables = make(map[tcpip.NetworkProtocolNumber]installedTable)
+			installedTables.lock.Unlock()
+
+			for i, step := range test.steps {
+				if got := updateInstalled(step.s, ipv4.ProtocolNumber, step.targets); got != step.want {
+					t.Errorf("step %d: updateInstalled() = %v, want %v", i, got, step.want)
+				}
+			}
+		})
+	}
+
+	// Each network protocol has its own table.
+	installedTables.lock.Lock()
+	installedTables.tables = make(map[tcpip.NetworkProtocolNumber]installedTable)
+	installedTables.lock.Unlock()
+	updateInstalled(s, ipv4.ProtocolNumber, []target{a})
+	if !updateInstalled(s, ipv6.ProtocolNumber, nil) {
+		t.Errorf("updateInstalled() of the first IPv6 table = false, want true")
+	}
+	if updateInstalled(s, ipv4.ProtocolNumber, []target{a}) {
+		t.Errorf("updateInstalled() of an unchanged IPv4 table = true after an IPv6 setup, want false")
+	}
+}
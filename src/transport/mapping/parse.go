@@ -0,0 +1,322 @@
+package mapping
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net/netip"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// Ports of well-known URL schemes, used when a URL entry has no explicit port.
+var schemePorts = map[string]uint16{
+	"http":  80,
+	"https": 443,
+	"ssh":   22,
+	"git":   9418,
+	"ldap":  389,
+	"ldaps": 636,
+}
+
+// loadHostsMapping reads the mapping file, if configured, followed by the hosts shorthand.
+func loadHostsMapping(get func(key string) string) ([]HostMapping, error) {
+	var result []HostMapping
+	var errs []error
+
+	if path := get("Mapping.File"); path != "" {
+		fileMappings, err := parseMappingFile(path)
+		errs = append(errs, errorList(err)...)
+		result = append(result, fileMappings...)
+	}
+
+	hostMappings, err := parseHostsMapping(get("Mapping.Hosts"))
+	errs = append(errs, errorList(err)...)
+	if len(errs) > 0 {
+		return nil, errors.Join(errs...)
+	}
+	return append(result, hostMappings...), nil
+}
+
+// errorList returns the errors joined in err, err alone when it is not joined, or none when it is nil.
+func errorList(err error) []error {
+	if err == nil {
+		return nil
+	}
+	if joined, ok := err.(interface{ Unwrap() []error }); ok {
+		return joined.Unwrap()
+	}
+	return []error{err}
+}
+
+// prefixErrors joins the errors of err again, each prefixed, so that every entry still reads on its own.
+func prefixErrors(prefix string, err error) error {
+	var errs []error
+	for _, entryErr := range errorList(err) {
+		errs = append(errs, fmt.Errorf("%s: %w", prefix, entryErr))
+	}
+	return errors.Join(errs...)
+}
+
+// HOSTS: "a.com:80:443,b.com:123,10.4.1.2:80:8080:81,h.com,x.com:123,dns.corp:53/udp,10.1.0.7=c.com:22,[fd::1]:443,https://d.com:8443,j.com:80->8080,v.com:5900-5999,w.com:*,10.1.0.64/26=10.20.0.0/26:22,*.corp.example:443"
+// Every invalid entry is reported, the errors are joined.
+func parseHostsMapping(input string) ([]HostMapping, error) {
+	var result []HostMapping
+	var errs []error
+
+	// iterate over host-port pairs
+	for _, mapping := range strings.Split(input, ",") {
+
+		// Remove leading or trailing spaces
+		mapping = strings.TrimSpace(mapping)
+
+		if len(mapping) == 0 {
+			continue
+		}
+
+		hostMapping, err := parseEntry(mapping)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("entry '%s': %w", mapping, err))
+			continue
+		}
+		result = append(result, hostMapping)
+	}
+
+	if len(errs) > 0 {
+		return nil, errors.Join(errs...)
+	}
+	return result, nil
+}
+
+// parseEntry parses a single shorthand entry: "[address=]host[:port...]" or "[address=]scheme://host[:port]".
+// The host may be a CIDR, which is mapped one-to-one, e.g. "10.1.0.64/26=10.20.0.0/26:22".
+func parseEntry(entry string) (HostMapping, error) {
+	// An explicit mapped address precedes the host, e.g. "10.1.0.7=c.com:22"
+	var address string
+	if value, rest, found := strings.Cut(entry, "="); found {
+		address = strings.TrimSpace(value)
+		entry = strings.TrimSpace(rest)
+	}
+
+	var hostMapping HostMapping
+	var err error
+	if strings.Contains(entry, "://") {
+		hostMapping, err = parseURLEntry(entry)
+	} else {
+		hostMapping, err = parseHostPorts(entry)
+	}
+	if err != nil {
+		return HostMapping{}, err
+	}
+
+	err = setAddresses(&hostMapping, address)
+	if err != nil {
+		return HostMapping{}, err
+	}
+	return hostMapping, nil
+}
+
+// maxSubnetBits limits subnet mappings to 65536 addresses.
+const maxSubnetBits = 16
+
+// setAddresses sets the subnet of a CIDR host and the explicit mapped address, if any.
+// The explicit address of a subnet may be given as a CIDR of the same size. Wildcard hosts have no address,
+// names under them get one when first queried.
+func setAddresses(hostMapping *HostMapping, address string) error {
+	if strings.Contains(hostMapping.Host, "*") {
+		if !isWildcard(hostMapping.Host) || strings.Count(hostMapping.Host, "*") > 1 || len(hostMapping.Host) < 3 {
+			return fmt.Errorf("invalid wildcard host '%s', only a leading '*.' is supported", hostMapping.Host)
+		}
+		if address != "" {
+			return fmt.Errorf("wildcard host %s cannot have a mapped address", hostMapping.Host)
+		}
+		return nil
+	}
+
+	if subnet, err := netip.ParsePrefix(hostMapping.Host); err == nil {
+		hostBits := subnet.Addr().BitLen() - subnet.Bits()
+		if hostBits > maxSubnetBits {
+			return fmt.Errorf("subnet %s is too large, at most %d host bits are supported", subnet, maxSubnetBits)
+		}
+		if hostBits > 0 {
+			hostMapping.Subnet = subnet.Masked()
+		}
+		hostMapping.Host = subnet.Masked().String()
+		if hostBits == 0 {
+			hostMapping.Host = subnet.Addr().String()
+		}
+	}
+
+	if address == "" {
+		return nil
+	}
+
+	if mapped, err := netip.ParsePrefix(address); err == nil {
+		if !hostMapping.Subnet.IsValid() || mapped.Bits() != hostMapping.Subnet.Bits() || mapped.Addr().Is6() != hostMapping.Subnet.Addr().Is6() {
+			return fmt.Errorf("mapped subnet %s does not match the size of %s", address, hostMapping.Host)
+		}
+		hostMapping.Address = mapped.Masked().Addr()
+		return nil
+	}
+
+	mapped, err := netip.ParseAddr(address)
+	if err != nil {
+		return fmt.Errorf("invalid mapped address '%s': %w", address, err)
+	}
+	hostMapping.Address = mapped
+	return nil
+}
+
+// parseHostPorts parses "host:port:port", where host may be a bracketed or bare IPv6 literal.
+func parseHostPorts(entry string) (HostMapping, error) {
+	var host string
+	var portValues []string
+
+	switch {
+	case strings.HasPrefix(entry, "["):
+		end := strings.Index(entry, "]")
+		if end < 0 {
+			return HostMapping{}, fmt.Errorf("missing ']' in '%s'", entry)
+		}
+		host = entry[1:end]
+		rest := entry[end+1:]
+		if rest != "" {
+			if !strings.HasPrefix(rest, ":") {
+				return HostMapping{}, fmt.Errorf("unexpected '%s' after host in '%s'", rest, entry)
+			}
+			portValues = strings.Split(rest[1:], ":")
+		}
+	default:
+		if addr, err := netip.ParseAddr(entry); err == nil && addr.Is6() {
+			// Bare IPv6 literal without ports
+			host = entry
+			break
+		}
+		if prefix, err := netip.ParsePrefix(entry); err == nil && prefix.Addr().Is6() {
+			// Bare IPv6 subnet without ports
+			host = entry
+			break
+		}
+		parts := strings.Split(entry, ":")
+		host = parts[0]
+		portValues = parts[1:]
+	}
+
+	if host == "" {
+		return HostMapping{}, fmt.Errorf("missing host in '%s'", entry)
+	}
+
+	ports, err := parsePorts(portValues)
+	if err != nil {
+		return HostMapping{}, err
+	}
+
+	return HostMapping{
+		Host:  host,
+		Ports: ports,
+	}, nil
+}
+
+// parseURLEntry parses a URL entry such as "https://gitlab.corp:8443", the port defaults to the scheme's port.
+func parseURLEntry(entry string) (HostMapping, error) {
+	u, err := url.Parse(entry)
+	if err != nil {
+		return HostMapping{}, fmt.Errorf("invalid URL '%s': %w", entry, err)
+	}
+
+	host := u.Hostname()
+	if host == "" {
+		return HostMapping{}, fmt.Errorf("missing host in '%s'", entry)
+	}
+
+	var port Port
+	if u.Port() != "" {
+		port, err = parsePort(u.Port())
+		if err != nil {
+			return HostMapping{}, err
+		}
+	} else {
+		number, ok := schemePorts[strings.ToLower(u.Scheme)]
+		if !ok {
+			return HostMapping{}, fmt.Errorf("no default port for scheme '%s' in '%s'", u.Scheme, entry)
+		}
+		port = Port{Number: number, Protocol: ProtocolTCP}
+	}
+
+	return HostMapping{
+		Host:  host,
+		Ports: []Port{port},
+	}, nil
+}
+
+// parsePorts parses a list of port values, using the default ports if it is empty.
+func parsePorts(values []string) ([]Port, error) {
+	if len(values) == 0 {
+		// Use default ports if none are provided
+		return []Port{{Number: 80, Protocol: ProtocolTCP}, {Number: 443, Protocol: ProtocolTCP}}, nil
+	}
+
+	var ports []Port
+	for _, value := range values {
+		port, err := parsePort(strings.TrimSpace(value))
+		if err != nil {
+			return nil, err
+		}
+		ports = append(ports, port)
+	}
+	return ports, nil
+}
+
+// parsePort parses a port, port range or "*" (all ports) with an optional backend port and protocol suffix,
+// e.g. "443", "53/udp", "80->8080", "5900-5999" or "*/udp".
+func parsePort(value string) (Port, error) {
+	ports, protocol, found := strings.Cut(value, "/")
+	port := Port{Protocol: ProtocolTCP}
+	if found {
+		switch Protocol(strings.ToLower(protocol)) {
+		case ProtocolTCP:
+		case ProtocolUDP:
+			port.Protocol = ProtocolUDP
+		default:
+			return Port{}, fmt.Errorf("invalid protocol '%s' for port '%s'", protocol, value)
+		}
+	}
+
+	number, target, translated := strings.Cut(ports, "->")
+	number = strings.TrimSpace(number)
+
+	if number == "*" {
+		port.Number, port.End = 1, math.MaxUint16
+	} else {
+		start, end, isRange := strings.Cut(number, "-")
+
+		// Parse string to uint
+		portUint, err := strconv.ParseUint(start, 10, 16)
+		if err != nil {
+			return Port{}, fmt.Errorf("invalid port value '%s': %w", value, err)
+		}
+		port.Number = uint16(portUint)
+
+		if isRange {
+			endUint, err := strconv.ParseUint(end, 10, 16)
+			if err != nil || endUint < portUint {
+				return Port{}, fmt.Errorf("invalid port range '%s'", value)
+			}
+			port.End = uint16(endUint)
+		}
+	}
+
+	if translated {
+		if port.isAll() {
+			return Port{}, fmt.Errorf("all ports cannot be translated in '%s'", value)
+		}
+		targetUint, err := strconv.ParseUint(strings.TrimSpace(target), 10, 16)
+		if err != nil || targetUint == 0 || targetUint+uint64(port.last()-port.Number) > math.MaxUint16 {
+			return Port{}, fmt.Errorf("invalid backend port in '%s'", value)
+		}
+		port.Target = uint16(targetUint)
+	}
+
+	return port, nil
+}
@@ -0,0 +1,206 @@
+package mapping
+
+import (
+	"net/netip"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParsePort(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    Port
+		wantErr string
+	}{
+		{value: "443", want: Port{Number: 443, Protocol: ProtocolTCP}},
+		{value: "443/tcp", want: Port{Number: 443, Protocol: ProtocolTCP}},
+		{value: "53/udp", want: Port{Number: 53, Protocol: ProtocolUDP}},
+		{value: "53/UDP", want: Port{Number: 53, Protocol: ProtocolUDP}},
+		{value: "80->8080", want: Port{Number: 80, Target: 8080, Protocol: ProtocolTCP}},
+		{value: "53->5353/udp", want: Port{Number: 53, Target: 5353, Protocol: ProtocolUDP}},
+		{value: "80->0", wantErr: "invalid backend port"},
+		{value: "80->http", wantErr: "invalid backend port"},
+		{value: "80->65536", wantErr: "invalid backend port"},
+		{value: "5900-5999", want: Port{Number: 5900, End: 5999, Protocol: ProtocolTCP}},
+		{value: "5900-5900", want: Port{Number: 5900, End: 5900, Protocol: ProtocolTCP}},
+		{value: "8000-8010->9000", want: Port{Number: 8000, End: 8010, Target: 9000, Protocol: ProtocolTCP}},
+		{value: "*", want: Port{Number: 1, End: 65535, Protocol: ProtocolTCP}},
+		{value: "*/udp", want: Port{Number: 1, End: 65535, Protocol: ProtocolUDP}},
+		{value: "5999-5900", wantErr: "invalid port range"},
+		{value: "5900-", wantErr: "invalid port range"},
+		{value: "100-200->65500", wantErr: "invalid backend port"},
+		{value: "*->80", wantErr: "all ports cannot be translated"},
+		{value: "53/icmp", wantErr: "invalid protocol"},
+		{value: "http", wantErr: "invalid port value"},
+		{value: "65536", wantErr: "invalid port value"},
+		{value: "", wantErr: "invalid port value"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.value, func(t *testing.T) {
+			port, err := parsePort(test.value)
+			if test.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+					t.Fatalf("parsePort(%q) error = %v, want %q", test.value, err, test.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parsePort(%q) error = %v", test.value, err)
+			}
+			if port != test.want {
+				t.Errorf("parsePort(%q) = %+v, want %+v", test.value, port, test.want)
+			}
+		})
+	}
+}
+
+func TestParseHostsMapping(t *testing.T) {
+	tcp := func(number uint16) Port { return Port{Number: number, Protocol: ProtocolTCP} }
+	udp := func(number uint16) Port { return Port{Number: number, Protocol: ProtocolUDP} }
+
+	tests := []struct {
+		name    string
+		input   string
+		want    []HostMapping
+		wantErr string
+	}{
+		{
+			name:  "empty",
+			input: " , ",
+		},
+		{
+			name:  "default ports",
+			input: "h.com",
+			want:  []HostMapping{{Host: "h.com", Ports: []Port{tcp(80), tcp(443)}}},
+		},
+		{
+			name:  "several hosts",
+			input: "a.com:80:443, b.com:123",
+			want: []HostMapping{
+				{Host: "a.com", Ports: []Port{tcp(80), tcp(443)}},
+				{Host: "b.com", Ports: []Port{tcp(123)}},
+			},
+		},
+		{
+			name:  "udp port",
+			input: "dns.corp:53/udp:53",
+			want:  []HostMapping{{Host: "dns.corp", Ports: []Port{udp(53), tcp(53)}}},
+		},
+		{
+			name:  "ipv6 literal",
+			input: "[fd::1]:443",
+			want:  []HostMapping{{Host: "fd::1", Ports: []Port{tcp(443)}}},
+		},
+		{
+			name:  "bare ipv6 literal",
+			input: "fd::1",
+			want:  []HostMapping{{Host: "fd::1", Ports: []Port{tcp(80), tcp(443)}}},
+		},
+		{
+			name:  "url with default port",
+			input: "https://d.com",
+			want:  []HostMapping{{Host: "d.com", Ports: []Port{tcp(443)}}},
+		},
+		{
+			name:  "url with port",
+			input: "https://d.com:8443",
+			want:  []HostMapping{{Host: "d.com", Ports: []Port{tcp(8443)}}},
+		},
+		{
+			name:  "explicit address",
+			input: "10.1.0.7=c.com:22",
+			want:  []HostMapping{{Host: "c.com", Ports: []Port{tcp(22)}, Address: netip.MustParseAddr("10.1.0.7")}},
+		},
+		{
+			name:  "subnet",
+			input: "10.1.0.64/26=10.20.0.5/26:22",
+			want: []HostMapping{{
+				Host:    "10.20.0.0/26",
+				Ports:   []Port{tcp(22)},
+				Subnet:  netip.MustParsePrefix("10.20.0.0/26"),
+				Address: netip.MustParseAddr("10.1.0.64"),
+			}},
+		},
+		{
+			name:  "single address subnet",
+			input: "10.20.0.5/32:22",
+			want:  []HostMapping{{Host: "10.20.0.5", Ports: []Port{tcp(22)}}},
+		},
+		{
+			name:  "wildcard",
+			input: "*.corp.example:443",
+			want:  []HostMapping{{Host: "*.corp.example", Ports: []Port{tcp(443)}}},
+		},
+		{
+			name:    "url without default port",
+			input:   "gopher://d.com",
+			wantErr: "no default port",
+		},
+		{
+			name:    "missing host",
+			input:   ":80",
+			wantErr: "missing host",
+		},
+		{
+			name:    "invalid address",
+			input:   "mapped=c.com:22",
+			wantErr: "invalid mapped address",
+		},
+		{
+			name:    "subnet address of another size",
+			input:   "10.1.0.0/24=10.20.0.0/26",
+			wantErr: "does not match the size",
+		},
+		{
+			name:    "subnet too large",
+			input:   "10.0.0.0/8",
+			wantErr: "too large",
+		},
+		{
+			name:    "inner wildcard",
+			input:   "a.*.example",
+			wantErr: "invalid wildcard host",
+		},
+		{
+			name:    "wildcard address",
+			input:   "10.1.0.7=*.corp.example",
+			wantErr: "cannot have a mapped address",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			hostMappings, err := parseHostsMapping(test.input)
+			if test.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+					t.Fatalf("parseHostsMapping(%q) error = %v, want %q", test.input, err, test.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseHostsMapping(%q) error = %v", test.input, err)
+			}
+			if !reflect.DeepEqual(hostMappings, test.want) {
+				t.Errorf("parseHostsMapping(%q) = %+v, want %+v", test.input, hostMappings, test.want)
+			}
+		})
+	}
+}
+
+func TestParseHostsMappingReportsEveryEntry(t *testing.T) {
+	_, err := parseHostsMapping("a.com:x,b.com,c.com:65536,10.0.0.0/8")
+	if err == nil {
+		t.Fatal("parseHostsMapping() succeeded, want an error")
+	}
+	errs := errorList(err)
+	if len(errs) != 3 {
+		t.Fatalf("parseHostsMapping() errors = %q, want 3", errs)
+	}
+	for i, entry := range []string{"a.com:x", "c.com:65536", "10.0.0.0/8"} {
+		if !strings.Contains(errs[i].Error(), entry) {
+			t.Errorf("error %d = %q, want it to name entry %q", i, errs[i], entry)
+		}
+	}
+}
@@ -0,0 +1,95 @@
+package mapping
+
+import (
+	"net"
+	"strings"
+	"time"
+)
+
+// PlannedHost is a mapping entry with the mapped addresses the agent gives it.
+type PlannedHost struct {
+	HostMapping
+	MappedAddress  string
+	MappedAddress6 string
+	MappedSubnet   string
+}
+
+// Plan is the mapping configuration as the agent would set it up.
+type Plan struct {
+	Hosts     []PlannedHost
+	Wildcards []HostMapping
+	Reverse   []Reverse
+	Prefix    string
+	Prefix6   string
+	overrides map[string][]net.IP
+}
+
+// LoadPlan reads and validates the mapping configuration with the same code as the agent and assigns
+// mapped addresses. Persisted orders are used but not updated, and nothing is set up.
+func LoadPlan() (*Plan, error) {
+	cfg, err := loadConfig(setting)
+	if err != nil {
+		return nil, err
+	}
+
+	hosts, wildcards := splitWildcards(cfg.hosts)
+	planner := allocator{readOnly: true}
+	err = planner.assign(hosts, cfg.prefix, cfg.prefix6)
+	if err != nil {
+		return nil, err
+	}
+
+	plan := &Plan{Wildcards: wildcards, Reverse: cfg.reverse, Prefix: cfg.prefix.String(), overrides: cfg.overrides}
+	if cfg.prefix6.IsValid() {
+		plan.Prefix6 = cfg.prefix6.String()
+	}
+
+	for _, host := range hosts {
+		planned := PlannedHost{HostMapping: host}
+		planned.Kind = serviceKind(host)
+		if host.Subnet.IsValid() {
+			prefix := cfg.prefix
+			if host.Subnet.Addr().Is6() {
+				prefix = cfg.prefix6
+			}
+			if mappedSubnet, err := host.mappedSubnet(prefix); err == nil {
+				planned.MappedSubnet = mappedSubnet.String()
+			}
+		} else {
+			if addr, err := mappedAddr(cfg.prefix, host.Order); err == nil {
+				planned.MappedAddress = addr.String()
+			}
+			if cfg.prefix6.IsValid() {
+				if addr, err := mappedAddr(cfg.prefix6, host.Order); err == nil {
+					planned.MappedAddress6 = addr.String()
+				}
+			}
+		}
+		plan.Hosts = append(plan.Hosts, planned)
+	}
+
+	return plan, nil
+}
+
+// Resolve resolves a host as the agent would, through the overrides and Mapping.Resolver, without caching.
+// It returns the addresses, where they came from (literal, override or dns) and the TTL of DNS answers.
+func (p *Plan) Resolve(host string) ([]net.IP, string, time.Duration, error) {
+	if ip := net.ParseIP(host); ip != nil {
+		return []net.IP{ip}, resolutionLiteral, 0, nil
+	}
+	if ips, ok := p.overrides[strings.TrimSuffix(strings.ToLower(host), ".")]; ok {
+		return ips, resolutionOverride, 0, nil
+	}
+
+	ips4, ips6, ttl, err := lookupHost(host)
+	if err != nil {
+		return nil, "dns", 0, err
+	}
+	return append(ips4, ips6...), "dns", ttl, nil
+}
+
+// Pinned returns whether a backend of a host, resolved from source, is dialed at its address rather than by name
+// through proxies.
+func (p *Plan) Pinned(host PlannedHost, source string) bool {
+	return pinnedResolution(host.HostMapping, source)
+}
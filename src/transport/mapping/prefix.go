@@ -0,0 +1,131 @@
+package mapping
+
+import (
+	"fmt"
+	"math"
+	"math/big"
+	"net/netip"
+	"strings"
+
+	"github.com/spf13/viper"
+)
+
+// prefixesFromConfig reads the IPv4 and optional IPv6 mapping prefixes and validates them against the tunnel addresses.
+func prefixesFromConfig(get func(key string) string) (netip.Prefix, netip.Prefix, error) {
+	prefix, err := parsePrefix(get("Mapping.Prefix"))
+	if err != nil {
+		return netip.Prefix{}, netip.Prefix{}, err
+	}
+	if !prefix.Addr().Is4() {
+		return netip.Prefix{}, netip.Prefix{}, fmt.Errorf("mapping prefix %s is not IPv4", prefix)
+	}
+
+	var prefix6 netip.Prefix
+	if value := get("Mapping.Prefix6"); value != "" && !viper.IsSet("disableipv6") {
+		prefix6, err = parsePrefix(value)
+		if err != nil {
+			return netip.Prefix{}, netip.Prefix{}, err
+		}
+		if !prefix6.Addr().Is6() {
+			return netip.Prefix{}, netip.Prefix{}, fmt.Errorf("IPv6 mapping prefix %s is not IPv6", prefix6)
+		}
+	}
+
+	for _, p := range []netip.Prefix{prefix, prefix6} {
+		if !p.IsValid() {
+			continue
+		}
+		if prefixCapacity(p) < 1 {
+			return netip.Prefix{}, netip.Prefix{}, fmt.Errorf("mapping prefix %s has no usable addresses", p)
+		}
+		for _, tunnel := range tunnelPrefixes() {
+			if p.Overlaps(tunnel) {
+				return netip.Prefix{}, netip.Prefix{}, fmt.Errorf("mapping prefix %s overlaps tunnel subnet %s", p, tunnel)
+			}
+		}
+	}
+
+	return prefix, prefix6, nil
+}
+
+// parsePrefix parses a CIDR prefix. The legacy three-octet form ("10.1.0") is read as a /24.
+func parsePrefix(value string) (netip.Prefix, error) {
+	value = strings.TrimSpace(value)
+	if !strings.Contains(value, "/") && strings.Count(value, ".") == 2 {
+		value = value + ".0/24"
+	}
+
+	prefix, err := netip.ParsePrefix(value)
+	if err != nil {
+		return netip.Prefix{}, fmt.Errorf("invalid mapping prefix '%s': %w", value, err)
+	}
+	return prefix.Masked(), nil
+}
+
+// TunnelSubnets are the subnets the tunnel interfaces are addressed from, set on startup. Mapping prefixes
+// must not overlap them.
+var TunnelSubnets []netip.Prefix
+
+// tunnelPrefixes returns the addresses used by the relay tunnel, mapped addresses must not collide with them.
+func tunnelPrefixes() []netip.Prefix {
+	prefixes := append([]netip.Prefix(nil), TunnelSubnets...)
+	for _, key := range []string{"Relay.Interface.ipv4", "Relay.Interface.ipv6", "E2EE.Interface.api"} {
+		if addr, err := netip.ParseAddr(viper.GetString(key)); err == nil {
+			prefixes = append(prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+		}
+	}
+	return append(prefixes, peerPrefixes()...)
+}
+
+// prefixCapacity returns the number of addresses of prefix that can be mapped.
+// The network address is never mapped, nor is the IPv4 broadcast address.
+func prefixCapacity(prefix netip.Prefix) int {
+	hostBits := prefix.Addr().BitLen() - prefix.Bits()
+	if hostBits >= 31 {
+		return math.MaxInt32
+	}
+
+	capacity := 1<<hostBits - 1
+	if prefix.Addr().Is4() && hostBits > 1 {
+		capacity--
+	}
+	return capacity
+}
+
+// mappedAddr returns the mapped address with the given order, starting from 1.
+func mappedAddr(prefix netip.Prefix, order int) (netip.Addr, error) {
+	if order < 1 || order > prefixCapacity(prefix) {
+		return netip.Addr{}, fmt.Errorf("order %d is outside of prefix %s", order, prefix)
+	}
+	return nthAddr(prefix, order)
+}
+
+// nthAddr returns the address at offset n from the start of prefix.
+func nthAddr(prefix netip.Prefix, n int) (netip.Addr, error) {
+	base := prefix.Masked().Addr()
+	value := new(big.Int).SetBytes(base.AsSlice())
+	value.Add(value, big.NewInt(int64(n)))
+	if value.BitLen() > base.BitLen() {
+		return netip.Addr{}, fmt.Errorf("offset %d overflows prefix %s", n, prefix)
+	}
+
+	addr, _ := netip.AddrFromSlice(value.FillBytes(make([]byte, base.BitLen()/8)))
+	if !prefix.Contains(addr) {
+		return netip.Addr{}, fmt.Errorf("offset %d is outside of prefix %s", n, prefix)
+	}
+	return addr, nil
+}
+
+// addrOffset returns the offset of addr from the start of prefix, or -1 if it is outside of it.
+func addrOffset(prefix netip.Prefix, addr netip.Addr) int {
+	if !prefix.Contains(addr) {
+		return -1
+	}
+
+	offset := new(big.Int).SetBytes(addr.AsSlice())
+	offset.Sub(offset, new(big.Int).SetBytes(prefix.Masked().Addr().AsSlice()))
+	if !offset.IsInt64() || offset.Int64() > math.MaxInt32 {
+		return -1
+	}
+	return int(offset.Int64())
+}
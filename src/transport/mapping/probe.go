@@ -0,0 +1,258 @@
+package mapping
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/spf13/viper"
+
+	"wiretap/transport/upstream"
+)
+
+const (
+	defaultProbeInterval = time.Minute
+	defaultProbeTimeout  = 5 * time.Second
+	// probeWorkers bounds the probes dialing at once, mappings may have thousands of backend ports.
+	probeWorkers = 32
+)
+
+// ProbeStatus is the result of the last reachability check of a backend port of a mapping.
+type ProbeStatus struct {
+	// Host is the mapped host, Backend the host dialed, which differs for mappings with backends.
+	Host    string
+	Backend string
+	// Address and Port are what was dialed: the resolved address of the backend and the backend port.
+	Address   string
+	Port      uint16
+	TLS       bool
+	Up        bool
+	Latency   time.Duration
+	LastError string
+	CheckedAt time.Time
+}
+
+// probe is a backend port of a mapping to check.
+type probe struct {
+	host    string
+	backend string
+	port    uint16
+	tls     bool
+}
+
+// key identifies the status of a probe. Mappings of the same host differ by their ports.
+func (p probe) key() string {
+	return fmt.Sprintf("%s %s:%d", p.host, p.backend, p.port)
+}
+
+// probes holds the last status of every probe, by key.
+var probes = struct {
+	lock     sync.RWMutex
+	statuses map[string]ProbeStatus
+}{statuses: make(map[string]ProbeStatus)}
+
+// Probe checks that the backends of the mappings are reachable every Mapping.Probe.Interval, from the
+// agent's network. Changes are logged and sent to the server.
+func Probe() {
+	interval := viper.GetDuration("Mapping.Probe.Interval")
+	if interval <= 0 {
+		interval = defaultProbeInterval
+	}
+
+	go syncStatuses()
+	for {
+		if changed := runProbes(currentProbes()); changed {
+			SendStatus(ProbeStatuses())
+		}
+		time.Sleep(interval)
+	}
+}
+
+// currentProbes returns the probes of the current mappings: every TCP port of every backend. Port ranges are
+// probed at their first port only, rather than scanned. Subnets and routed mappings, which have no single
+// backend, are not probed.
+func currentProbes() []probe {
+	current.lock.Lock()
+	hosts := append([]HostMapping(nil), current.hosts...)
+	current.lock.Unlock()
+
+	tlsPorts, err := parseProbeTLSPorts(viper.GetString("Mapping.Probe.TLSPorts"))
+	if err != nil {
+		log.Println("Probing without TLS:", err)
+	}
+
+	var result []probe
+	seen := make(map[string]bool)
+	for _, mapping := range hosts {
+		if mapping.Subnet.IsValid() || mapping.Routing != "" {
+			continue
+		}
+		for _, backend := range mapping.BackendHosts() {
+			for _, port := range mapping.Ports {
+				if port.Protocol != ProtocolTCP {
+					continue
+				}
+				backendPort := port.backendPort(port.Number)
+				p := probe{host: mapping.Host, backend: backend, port: backendPort, tls: tlsPorts[backendPort] || mapping.TLS != nil}
+				if !seen[p.key()] {
+					seen[p.key()] = true
+					result = append(result, p)
+				}
+			}
+		}
+	}
+	return result
+}
+
+// parseProbeTLSPorts parses Mapping.Probe.TLSPorts, the backend ports that are checked with a TLS handshake.
+func parseProbeTLSPorts(input string) (map[uint16]bool, error) {
+	ports := make(map[uint16]bool)
+	for _, value := range strings.FieldsFunc(input, func(r rune) bool { return r == ',' || r == ' ' }) {
+		port, err := strconv.ParseUint(value, 10, 16)
+		if err != nil || port == 0 {
+			return nil, fmt.Errorf("invalid TLS port '%s'", value)
+		}
+		ports[uint16(port)] = true
+	}
+	return ports, nil
+}
+
+// runProbes checks the probes, probeWorkers at a time, records their statuses and returns whether any mapping
+// went up or down, changed address, or was added or removed.
+func runProbes(toProbe []probe) bool {
+	timeout := viper.GetDuration("Mapping.Probe.Timeout")
+	if timeout <= 0 {
+		timeout = defaultProbeTimeout
+	}
+
+	keys := make([]string, len(toProbe))
+	results := make([]ProbeStatus, len(toProbe))
+	next := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < probeWorkers && w < len(toProbe); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range next {
+				results[i] = toProbe[i].check(timeout)
+			}
+		}()
+	}
+	for i, p := range toProbe {
+		keys[i] = p.key()
+		next <- i
+	}
+	close(next)
+	wg.Wait()
+
+	probes.lock.Lock()
+	defer probes.lock.Unlock()
+
+	changed := len(results) != len(probes.statuses)
+	statuses := make(map[string]ProbeStatus, len(results))
+	for i, status := range results {
+		previous, found := probes.statuses[keys[i]]
+		switch {
+		case !found:
+			changed = true
+		case previous.Up != status.Up || previous.Address != status.Address || previous.Port != status.Port:
+			changed = true
+		}
+		if (!found && !status.Up) || (found && previous.Up != status.Up) {
+			if status.Up {
+				log.Printf("Mapping %s backend %s:%d is reachable at %s\n", status.Host, status.Backend, status.Port, status.Address)
+			} else {
+				log.Printf("Mapping %s backend %s:%d is unreachable: %s\n", status.Host, status.Backend, status.Port, status.LastError)
+			}
+		}
+		statuses[keys[i]] = status
+	}
+	probes.statuses = statuses
+	return changed
+}
+
+// check dials the probe, and completes a TLS handshake when requested.
+func (p probe) check(timeout time.Duration) ProbeStatus {
+	status := ProbeStatus{Host: p.host, Backend: p.backend, Port: p.port, TLS: p.tls, CheckedAt: time.Now()}
+
+	ip4, ip6, err := resolveIP(p.backend)
+	if err != nil {
+		status.LastError = err.Error()
+		return status
+	}
+	ip := ip4
+	if ip == nil {
+		ip = ip6
+	}
+	status.Address = ip.String()
+
+	start := time.Now()
+	conn, err := upstream.DialTimeout(net.JoinHostPort(status.Address, fmt.Sprint(p.port)), timeout)
+	if err != nil {
+		status.LastError = err.Error()
+		return status
+	}
+	defer conn.Close()
+
+	if p.tls {
+		// The handshake shows a TLS service answers, certificates are checked by the clients of the mapping.
+		tlsConn := tls.Client(conn, &tls.Config{ServerName: p.backend, InsecureSkipVerify: true})
+		tlsConn.SetDeadline(time.Now().Add(timeout))
+		err = tlsConn.Handshake()
+		if err != nil {
+			status.LastError = err.Error()
+			return status
+		}
+	}
+
+	status.Latency = time.Since(start)
+	status.Up = true
+	return status
+}
+
+// ProbeStatuses returns the last status of every probe, sorted by host, backend and port.
+func ProbeStatuses() []ProbeStatus {
+	probes.lock.RLock()
+	defer probes.lock.RUnlock()
+
+	statuses := make([]ProbeStatus, 0, len(probes.statuses))
+	for _, status := range probes.statuses {
+		statuses = append(statuses, status)
+	}
+	sort.Slice(statuses, func(i, j int) bool {
+		a, b := statuses[i], statuses[j]
+		if a.Host != b.Host {
+			return a.Host < b.Host
+		}
+		if a.Backend != b.Backend {
+			return a.Backend < b.Backend
+		}
+		return a.Port < b.Port
+	})
+	return statuses
+}
+
+// HandleProbes serves the probe statuses as JSON, as they are sent to the server. It answers 503 when any
+// mapping is unreachable.
+func HandleProbes(w http.ResponseWriter, r *http.Request) {
+	statuses := ProbeStatuses()
+	w.Header().Set("Content-Type", "application/json")
+	for _, status := range statuses {
+		if !status.Up {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			break
+		}
+	}
+	err := json.NewEncoder(w).Encode(statusRequest(statuses))
+	if err != nil {
+		log.Println("Error writing probe statuses:", err)
+	}
+}
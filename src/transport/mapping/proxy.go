@@ -0,0 +1,224 @@
+package mapping
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/adapters/gonet"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/tcp"
+	"gvisor.dev/gvisor/pkg/waiter"
+
+	"wiretap/transport/upstream"
+)
+
+// backendDialTimeout bounds the connections proxies make to backends.
+const backendDialTimeout = 10 * time.Second
+
+// proxyConn is a connection accepted by a proxy.
+type proxyConn struct {
+	*gonet.TCPConn
+	ep tcpip.Endpoint
+}
+
+// reset closes the connection with a reset, telling the client the connection is refused.
+func (c *proxyConn) reset() {
+	c.ep.SocketOptions().SetLinger(tcpip.LingerOption{Enabled: true, Timeout: 0})
+	c.Close()
+}
+
+// proxyHandler serves a connection accepted by a proxy. It owns the connection.
+type proxyHandler func(conn *proxyConn)
+
+// proxy serves a mapped TCP port inside the netstack. The NAT table translates new connections to the
+// mapped port to the listener of the proxy, on the main address of the stack, instead of to a backend.
+type proxy struct {
+	name    string
+	ep      tcpip.Endpoint
+	wq      *waiter.Queue
+	closed  chan struct{}
+	local   tcpip.FullAddress
+	handler atomic.Pointer[proxyHandler]
+}
+
+// listenProxy listens on an ephemeral port of addr.
+func listenProxy(s *stack.Stack, netProto tcpip.NetworkProtocolNumber, addr tcpip.Address) (*proxy, error) {
+	var wq waiter.Queue
+	ep, err := s.NewEndpoint(tcp.ProtocolNumber, netProto, &wq)
+	if err != nil {
+		return nil, errors.New(err.String())
+	}
+	if err := ep.Bind(tcpip.FullAddress{Addr: addr}); err != nil {
+		ep.Close()
+		return nil, fmt.Errorf("bind: %s", err)
+	}
+	if err := ep.Listen(1024); err != nil {
+		ep.Close()
+		return nil, fmt.Errorf("listen: %s", err)
+	}
+	local, err := ep.GetLocalAddress()
+	if err != nil {
+		ep.Close()
+		return nil, errors.New(err.String())
+	}
+
+	return &proxy{ep: ep, wq: &wq, closed: make(chan struct{}), local: local}, nil
+}
+
+// serve accepts connections until the proxy is closed. Accepted connections are not affected by closing.
+func (p *proxy) serve() {
+	waitEntry, notifyCh := waiter.NewChannelEntry(waiter.ReadableEvents)
+	p.wq.EventRegister(&waitEntry)
+	defer p.wq.EventUnregister(&waitEntry)
+
+	for {
+		ep, wq, err := p.ep.Accept(nil)
+		if _, ok := err.(*tcpip.ErrWouldBlock); ok {
+			select {
+			case <-notifyCh:
+				continue
+			case <-p.closed:
+				return
+			}
+		}
+		if err != nil {
+			return
+		}
+
+		handler := *p.handler.Load()
+		go handler(&proxyConn{TCPConn: gonet.NewTCPConn(wq, ep), ep: ep})
+	}
+}
+
+func (p *proxy) close() {
+	close(p.closed)
+	p.ep.Close()
+}
+
+// proxies are the proxies by mapped address and port. They outlive setups so that their listeners are kept.
+var proxies = struct {
+	lock  sync.Mutex
+	byKey map[string]*proxy
+}{byKey: make(map[string]*proxy)}
+
+// proxyFor returns the proxy of a mapped port with the given handler, listening when new.
+func proxyFor(s *stack.Stack, netProto tcpip.NetworkProtocolNumber, mapped tcpip.Address, port uint16, name string, handler proxyHandler) (*proxy, error) {
+	proxies.lock.Lock()
+	defer proxies.lock.Unlock()
+
+	key := net.JoinHostPort(mapped.String(), fmt.Sprint(port))
+	if p, ok := proxies.byKey[key]; ok {
+		p.name = name
+		p.handler.Store(&handler)
+		return p, nil
+	}
+
+	local, err := s.GetMainNICAddress(1, netProto)
+	if err != nil {
+		return nil, fmt.Errorf("no local address: %s", err)
+	}
+	p, lerr := listenProxy(s, netProto, local.Address)
+	if lerr != nil {
+		return nil, lerr
+	}
+
+	p.name = name
+	p.handler.Store(&handler)
+	proxies.byKey[key] = p
+	go p.serve()
+	return p, nil
+}
+
+// retainProxies closes the proxies of mapped ports that are no longer proxied. Accepted connections are not affected.
+func retainProxies(targets []target) {
+	proxies.lock.Lock()
+	defer proxies.lock.Unlock()
+
+	used := make(map[*proxy]bool)
+	for _, t := range targets {
+		for _, p := range t.proxies {
+			used[p] = true
+		}
+	}
+	for key, p := range proxies.byKey {
+		if !used[p] {
+			p.close()
+			delete(proxies.byKey, key)
+		}
+	}
+}
+
+// proxyHandlerFor returns the handler of a TCP port of a target, or nil when it is translated to the backend.
+func proxyHandlerFor(mapping HostMapping, t target, port Port) (proxyHandler, error) {
+	switch {
+	case mapping.Routing == RoutingSNI:
+		return sniHandler(mapping, port), nil
+	case mapping.Routing == RoutingHTTP:
+		return httpHandler(mapping, port), nil
+	case mapping.TLS != nil:
+		return tlsOriginationHandler(mapping, t, port)
+	}
+	return nil, nil
+}
+
+// proxyTargets serves the TCP ports of mappings that need a proxy, such as TLS origination and routing. Ports
+// that cannot be proxied are left out, rather than translated to the backend as they are. The caller holds current.lock.
+func proxyTargets(mapping HostMapping, targets []target, netProto tcpip.NetworkProtocolNumber) {
+	if mapping.TLS == nil && mapping.Routing == "" {
+		return
+	}
+
+	for i := range targets {
+		t := &targets[i]
+		ports := make([]Port, 0, len(t.ports))
+		for _, port := range t.ports {
+			if port.Protocol != ProtocolTCP {
+				ports = append(ports, port)
+				continue
+			}
+
+			name := fmt.Sprintf("%s:%d", mapping.Host, port.Number)
+			handler, err := proxyHandlerFor(mapping, *t, port)
+			if err != nil {
+				log.Println("Unable to serve", name, err)
+				continue
+			}
+			p, err := proxyFor(current.s, netProto, t.mapped, port.Number, name, handler)
+			if err != nil {
+				log.Println("Unable to proxy", name, err)
+				continue
+			}
+
+			if t.proxies == nil {
+				t.proxies = make(map[uint16]*proxy)
+			}
+			t.proxies[port.Number] = p
+			ports = append(ports, port)
+		}
+		t.ports = ports
+	}
+}
+
+// backendAddress returns the address of the backend of a new connection to a port of a target.
+func (t target) backendAddress(port Port) (string, bool) {
+	backend := t.backend
+	if t.pool != nil {
+		var ok bool
+		backend, ok = t.pool.pick()
+		if !ok {
+			return "", false
+		}
+	}
+	return net.JoinHostPort(backend.String(), fmt.Sprint(port.backendPort(port.Number))), true
+}
+
+// dialBackend connects to a backend from the network of the agent, through the upstream proxy if any.
+func dialBackend(address string) (net.Conn, error) {
+	return upstream.DialTimeout(address, backendDialTimeout)
+}
@@ -0,0 +1,558 @@
+package mapping
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/spf13/viper"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const (
+	defaultMinTTL       = 30 * time.Second
+	defaultMaxTTL       = 10 * time.Minute
+	resolveTimeout      = 5 * time.Second
+	firstResolveBackoff = 5 * time.Second
+	// minRefreshDelay keeps a burst of expiring hosts in a single refresh.
+	minRefreshDelay = time.Second
+)
+
+// resolution is the cached result of resolving a host. A host that resolved once keeps its addresses
+// while lookups fail, so its mapping stays in place until the host resolves again.
+type resolution struct {
+	ips4, ips6 []net.IP
+	resolved   bool
+	err        error
+	failures   int
+	// expires is when the host is resolved again: after its TTL, or after a backoff when the lookup failed.
+	expires time.Time
+	// used is set whenever the resolution is looked up, resolutions left unused by a setup are dropped.
+	used bool
+}
+
+// resolutions caches host lookups and wakes the refresh loop when a host must be resolved sooner.
+var resolutions = struct {
+	lock      sync.Mutex
+	byHost    map[string]*resolution
+	overrides map[string][]net.IP
+	wake      chan struct{}
+}{byHost: make(map[string]*resolution), wake: make(chan struct{}, 1)}
+
+// parseOverrides parses Mapping.Overrides, host addresses that take precedence over DNS. Entries are
+// separated by commas or new lines and are either host=ip or hosts file lines, ip followed by hosts:
+//
+//	gitlab.corp=10.0.0.5,jira.corp=10.0.0.6
+//	10.0.0.7 artifactory.corp artifactory-ha.corp
+//
+// A host may be listed several times, with an IPv4 and an IPv6 address for example.
+func parseOverrides(input string) (map[string][]net.IP, error) {
+	overrides := make(map[string][]net.IP)
+	for _, entry := range strings.FieldsFunc(input, func(r rune) bool { return r == ',' || r == '\n' }) {
+		entry, _, _ = strings.Cut(entry, "#")
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		var address string
+		var hosts []string
+		if host, value, found := strings.Cut(entry, "="); found {
+			address, hosts = strings.TrimSpace(value), []string{strings.TrimSpace(host)}
+		} else {
+			fields := strings.Fields(entry)
+			address, hosts = fields[0], fields[1:]
+		}
+
+		ip := net.ParseIP(address)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid override '%s': '%s' is not an IP address", entry, address)
+		}
+		if ip4 := ip.To4(); ip4 != nil {
+			ip = ip4
+		}
+		if len(hosts) == 0 || hosts[0] == "" {
+			return nil, fmt.Errorf("invalid override '%s': missing host", entry)
+		}
+		for _, host := range hosts {
+			host = strings.TrimSuffix(strings.ToLower(host), ".")
+			overrides[host] = append(overrides[host], ip)
+		}
+	}
+	return overrides, nil
+}
+
+// setOverrides replaces the overrides. Only the cached lookups of hosts whose override changed are dropped,
+// the others keep their addresses, so that a reload during a resolver outage keeps every backend.
+func setOverrides(overrides map[string][]net.IP) {
+	resolutions.lock.Lock()
+	defer resolutions.lock.Unlock()
+
+	for host, ips := range resolutions.overrides {
+		if !sameIPs(ips, overrides[host]) {
+			delete(resolutions.byHost, host)
+		}
+	}
+	for host := range overrides {
+		if _, ok := resolutions.overrides[host]; !ok {
+			delete(resolutions.byHost, host)
+		}
+	}
+	resolutions.overrides = overrides
+}
+
+func sameIPs(a []net.IP, b []net.IP) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if !a[i].Equal(b[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// resolveAll resolves the hosts whose lookup expired, a few at a time.
+func resolveAll(hosts []string) {
+	const workers = 8
+
+	var wg sync.WaitGroup
+	queue := make(chan string)
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for host := range queue {
+				resolveIPs(host)
+			}
+		}()
+	}
+	for _, host := range hosts {
+		queue <- host
+	}
+	close(queue)
+	wg.Wait()
+}
+
+// sweepResolutions drops the resolutions of hosts that were not looked up since the previous sweep.
+func sweepResolutions() {
+	resolutions.lock.Lock()
+	defer resolutions.lock.Unlock()
+
+	for host, r := range resolutions.byHost {
+		if !r.used {
+			delete(resolutions.byHost, host)
+			continue
+		}
+		r.used = false
+	}
+}
+
+// nextResolution returns when the next host must be resolved again.
+func nextResolution() time.Time {
+	resolutions.lock.Lock()
+	defer resolutions.lock.Unlock()
+
+	now := time.Now()
+	next := now.Add(ttlBounds().max)
+	for _, r := range resolutions.byHost {
+		if r.expires.Before(next) {
+			next = r.expires
+		}
+	}
+	if next.Before(now.Add(minRefreshDelay)) {
+		next = now.Add(minRefreshDelay)
+	}
+	return next
+}
+
+type ttlRange struct {
+	min, max time.Duration
+}
+
+// ttlBounds returns the clamp of record TTLs, Mapping.TTL.Min and Mapping.TTL.Max.
+func ttlBounds() ttlRange {
+	bounds := ttlRange{min: viper.GetDuration("Mapping.TTL.Min"), max: viper.GetDuration("Mapping.TTL.Max")}
+	if bounds.min <= 0 {
+		bounds.min = defaultMinTTL
+	}
+	if bounds.max <= 0 {
+		bounds.max = defaultMaxTTL
+	}
+	if bounds.max < bounds.min {
+		bounds.max = bounds.min
+	}
+	return bounds
+}
+
+func (b ttlRange) clamp(ttl time.Duration) time.Duration {
+	if ttl < b.min {
+		return b.min
+	}
+	if ttl > b.max {
+		return b.max
+	}
+	return ttl
+}
+
+// backoff returns the delay before the next lookup of a host that failed failures times in a row.
+func (b ttlRange) backoff(failures int) time.Duration {
+	delay := firstResolveBackoff
+	for i := 1; i < failures && delay < b.max; i++ {
+		delay *= 2
+	}
+	if delay > b.max {
+		return b.max
+	}
+	return delay
+}
+
+// resolveIP returns the first IPv4 and the first IPv6 address of host, either may be nil.
+func resolveIP(host string) (net.IP, net.IP, error) {
+	ips4, ips6, err := resolveIPs(host)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var ip4, ip6 net.IP
+	if len(ips4) > 0 {
+		ip4 = ips4[0]
+	}
+	if len(ips6) > 0 {
+		ip6 = ips6[0]
+	}
+	return ip4, ip6, nil
+}
+
+// resolveIPs returns every IPv4 and IPv6 address of host. Overrides come first, then the cached lookup
+// until it expires. A failed lookup is retried with backoff, meanwhile the previous addresses are used.
+func resolveIPs(host string) ([]net.IP, []net.IP, error) {
+	ip := net.ParseIP(host)
+	if ip != nil {
+		// Hostname is already an IP address
+		if ip4 := ip.To4(); ip4 != nil {
+			return []net.IP{ip4}, nil, nil
+		}
+		return nil, []net.IP{ip.To16()}, nil
+	}
+
+	key := strings.TrimSuffix(strings.ToLower(host), ".")
+
+	resolutions.lock.Lock()
+	if ips, ok := resolutions.overrides[key]; ok {
+		resolutions.lock.Unlock()
+		return splitFamilies(ips)
+	}
+	r, ok := resolutions.byHost[key]
+	if ok {
+		r.used = true
+		if time.Now().Before(r.expires) {
+			defer resolutions.lock.Unlock()
+			if r.resolved {
+				return r.ips4, r.ips6, nil
+			}
+			return nil, nil, r.err
+		}
+	}
+	resolutions.lock.Unlock()
+
+	// Hostname is not in IP format, resolve it
+	ips4, ips6, ttl, err := lookupHost(key)
+	bounds := ttlBounds()
+
+	resolutions.lock.Lock()
+	defer resolutions.lock.Unlock()
+
+	if r == nil {
+		r = &resolution{}
+		resolutions.byHost[key] = r
+	}
+	r.used = true
+
+	var partial *partialError
+	if errors.As(err, &partial) {
+		// The family that failed keeps its previous records, and the host is resolved again soon.
+		if partial.ipv6 {
+			ips6 = r.ips6
+		} else {
+			ips4 = r.ips4
+		}
+		r.failures++
+		delay := bounds.backoff(r.failures)
+		if clamped := bounds.clamp(ttl); clamped < delay {
+			delay = clamped
+		}
+		log.Printf("Unable to resolve IP %s fully, keeping %v %v, retrying in %s (attempt %d): %v\n", host, ips4, ips6, delay, r.failures, err)
+		r.ips4, r.ips6, r.resolved, r.err = ips4, ips6, true, err
+		r.expires = time.Now().Add(delay)
+		select {
+		case resolutions.wake <- struct{}{}:
+		default:
+		}
+		return ips4, ips6, nil
+	}
+
+	if err != nil {
+		r.err = err
+		r.failures++
+		delay := bounds.backoff(r.failures)
+		r.expires = time.Now().Add(delay)
+		select {
+		case resolutions.wake <- struct{}{}:
+		default:
+		}
+
+		if r.resolved {
+			log.Printf("Unable to resolve IP %s, keeping %v %v, retrying in %s (attempt %d): %v\n", host, r.ips4, r.ips6, delay, r.failures, err)
+			return r.ips4, r.ips6, nil
+		}
+		log.Printf("Unable to resolve IP %s, retrying in %s (attempt %d): %v\n", host, delay, r.failures, err)
+		return nil, nil, err
+	}
+
+	if r.failures > 0 {
+		log.Printf("Resolved IP %s after %d failed attempts\n", host, r.failures)
+	}
+	r.ips4, r.ips6, r.resolved, r.err, r.failures = ips4, ips6, true, nil, 0
+	r.expires = time.Now().Add(bounds.clamp(ttl))
+
+	if viper.GetBool("verbose") {
+		log.Println("Resolved IP", host, ips4, ips6, "TTL", ttl)
+	}
+	return ips4, ips6, nil
+}
+
+func splitFamilies(ips []net.IP) ([]net.IP, []net.IP, error) {
+	var ips4, ips6 []net.IP
+	for _, ip := range ips {
+		if v4 := ip.To4(); v4 != nil {
+			ips4 = append(ips4, v4)
+		} else {
+			ips6 = append(ips6, ip.To16())
+		}
+	}
+	return ips4, ips6, nil
+}
+
+// lookupHost resolves host through Mapping.Resolver, or the system resolver when none is configured.
+// Only a configured resolver reports TTLs, a zero TTL is clamped to Mapping.TTL.Min.
+func lookupHost(host string) ([]net.IP, []net.IP, time.Duration, error) {
+	server := viper.GetString("Mapping.Resolver")
+	if server == "" {
+		ctx, cancel := context.WithTimeout(context.Background(), resolveTimeout)
+		defer cancel()
+
+		resolvedIPs, err := net.DefaultResolver.LookupIP(ctx, "ip", host)
+		if err != nil {
+			return nil, nil, 0, err
+		}
+		ips4, ips6, _ := splitFamilies(resolvedIPs)
+		// Without TTLs, hosts are resolved again after Mapping.TTL.Max, as often as they used to be.
+		return ips4, ips6, ttlBounds().max, nil
+	}
+
+	if _, _, err := net.SplitHostPort(server); err != nil {
+		server = net.JoinHostPort(server, fmt.Sprint(dnsPort))
+	}
+
+	var ips4, ips6 []net.IP
+	var ttl4, ttl6 time.Duration
+	var err4, err6 error
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		ips6, ttl6, err6 = queryResolver(server, host, dnsmessage.TypeAAAA)
+	}()
+	ips4, ttl4, err4 = queryResolver(server, host, dnsmessage.TypeA)
+	wg.Wait()
+
+	// A name without records of a family is an answer, not a failure.
+	failed4 := err4 != nil && !errors.Is(err4, errNoSuchHost)
+	failed6 := err6 != nil && !errors.Is(err6, errNoSuchHost)
+	switch {
+	case failed4 && failed6:
+		return nil, nil, 0, err4
+	case failed4 && len(ips6) == 0:
+		return nil, nil, 0, err4
+	case failed6 && len(ips4) == 0:
+		return nil, nil, 0, err6
+	}
+	if len(ips4) == 0 && len(ips6) == 0 {
+		return nil, nil, 0, errNoSuchHost
+	}
+
+	ttl := ttl4
+	if len(ips4) == 0 || (len(ips6) > 0 && ttl6 < ttl) {
+		ttl = ttl6
+	}
+	switch {
+	case failed4:
+		return nil, ips6, ttl, &partialError{err: err4}
+	case failed6:
+		return ips4, nil, ttl, &partialError{ipv6: true, err: err6}
+	}
+	return ips4, ips6, ttl, nil
+}
+
+// partialError is returned by lookupHost when the query of one address family failed and the other answered.
+type partialError struct {
+	ipv6 bool
+	err  error
+}
+
+func (e *partialError) Error() string {
+	if e.ipv6 {
+		return fmt.Sprintf("AAAA query failed: %v", e.err)
+	}
+	return fmt.Sprintf("A query failed: %v", e.err)
+}
+
+func (e *partialError) Unwrap() error {
+	return e.err
+}
+
+// queryResolver asks server for the records of a type and returns their addresses and lowest TTL.
+// Names are queried as given, the search domains of the agent do not apply.
+func queryResolver(server string, host string, qtype dnsmessage.Type) ([]net.IP, time.Duration, error) {
+	name, err := dnsmessage.NewName(canonicalName(host))
+	if err != nil {
+		return nil, 0, err
+	}
+
+	query := dnsmessage.Message{
+		Header:    dnsmessage.Header{ID: uint16(rand.Uint32()), RecursionDesired: true},
+		Questions: []dnsmessage.Question{{Name: name, Type: qtype, Class: dnsmessage.ClassINET}},
+	}
+	packed, err := query.Pack()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	response, err := exchange("udp", server, packed)
+	if err == nil && response.Truncated {
+		response, err = exchange("tcp", server, packed)
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+	if response.ID != query.ID {
+		return nil, 0, errors.New("mismatched DNS response")
+	}
+
+	switch response.RCode {
+	case dnsmessage.RCodeSuccess:
+	case dnsmessage.RCodeNameError:
+		return nil, 0, errNoSuchHost
+	default:
+		return nil, 0, fmt.Errorf("resolver %s answered %s", server, response.RCode)
+	}
+
+	// CNAME chains are answered along with their records, only the addresses matter.
+	var ips []net.IP
+	var ttl uint32
+	for _, answer := range response.Answers {
+		var ip net.IP
+		switch body := answer.Body.(type) {
+		case *dnsmessage.AResource:
+			ip = net.IP(body.A[:])
+		case *dnsmessage.AAAAResource:
+			ip = net.IP(body.AAAA[:])
+		default:
+			continue
+		}
+		if len(ips) == 0 || answer.Header.TTL < ttl {
+			ttl = answer.Header.TTL
+		}
+		ips = append(ips, ip)
+	}
+	return ips, time.Duration(ttl) * time.Second, nil
+}
+
+// exchange sends a DNS query over udp or tcp and reads the response.
+func exchange(network string, server string, query []byte) (*dnsmessage.Message, error) {
+	conn, err := net.DialTimeout(network, server, resolveTimeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(resolveTimeout))
+
+	var response []byte
+	if network == "tcp" {
+		framed := binary.BigEndian.AppendUint16(nil, uint16(len(query)))
+		if _, err = conn.Write(append(framed, query...)); err != nil {
+			return nil, err
+		}
+		var length [2]byte
+		if _, err = io.ReadFull(conn, length[:]); err != nil {
+			return nil, err
+		}
+		response = make([]byte, binary.BigEndian.Uint16(length[:]))
+		if _, err = io.ReadFull(conn, response); err != nil {
+			return nil, err
+		}
+	} else {
+		if _, err = conn.Write(query); err != nil {
+			return nil, err
+		}
+		response = make([]byte, 65535)
+		n, err := conn.Read(response)
+		if err != nil {
+			return nil, err
+		}
+		response = response[:n]
+	}
+
+	var message dnsmessage.Message
+	if err := message.Unpack(response); err != nil {
+		return nil, err
+	}
+	return &message, nil
+}
+
+// Resolution states reported in the manifest.
+const (
+	resolutionLiteral  = "literal"
+	resolutionOverride = "override"
+	resolutionResolved = "resolved"
+	resolutionStale    = "stale"
+	resolutionFailed   = "failed"
+	resolutionPending  = "pending"
+)
+
+// resolutionOf returns how host was last resolved, its addresses and the error of its last lookup, if any.
+// It does not resolve the host.
+func resolutionOf(host string) (string, []net.IP, error) {
+	if ip := net.ParseIP(host); ip != nil {
+		return resolutionLiteral, []net.IP{ip}, nil
+	}
+
+	key := strings.TrimSuffix(strings.ToLower(host), ".")
+
+	resolutions.lock.Lock()
+	defer resolutions.lock.Unlock()
+
+	if ips, ok := resolutions.overrides[key]; ok {
+		return resolutionOverride, ips, nil
+	}
+	r, ok := resolutions.byHost[key]
+	switch {
+	case !ok:
+		return resolutionPending, nil, nil
+	case r.resolved && r.err != nil:
+		return resolutionStale, append(append([]net.IP(nil), r.ips4...), r.ips6...), r.err
+	case r.resolved:
+		return resolutionResolved, append(append([]net.IP(nil), r.ips4...), r.ips6...), nil
+	}
+	return resolutionFailed, nil, r.err
+}
@@ -0,0 +1,171 @@
+package mapping
+
+import (
+	"net"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseOverrides(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   string
+		want    map[string][]string
+		wantErr string
+	}{
+		{
+			name:  "empty",
+			input: " , \n",
+			want:  map[string][]string{},
+		},
+		{
+			name:  "host and address",
+			input: "gitlab.corp=10.0.0.5, jira.corp = 10.0.0.6",
+			want:  map[string][]string{"gitlab.corp": {"10.0.0.5"}, "jira.corp": {"10.0.0.6"}},
+		},
+		{
+			name:  "hosts file lines",
+			input: "10.0.0.7 artifactory.corp artifactory-ha.corp\nfd::7\tartifactory.corp",
+			want: map[string][]string{
+				"artifactory.corp":    {"10.0.0.7", "fd::7"},
+				"artifactory-ha.corp": {"10.0.0.7"},
+			},
+		},
+		{
+			name:  "comments",
+			input: "# corp hosts\n10.0.0.7 a.corp # primary\n",
+			want:  map[string][]string{"a.corp": {"10.0.0.7"}},
+		},
+		{
+			name:  "case and trailing dot",
+			input: "A.Corp.=10.0.0.5",
+			want:  map[string][]string{"a.corp": {"10.0.0.5"}},
+		},
+		{
+			name:  "repeated host",
+			input: "a.corp=10.0.0.5,a.corp=fd::5",
+			want:  map[string][]string{"a.corp": {"10.0.0.5", "fd::5"}},
+		},
+		{
+			name:    "invalid address",
+			input:   "a.corp=10.0.0",
+			wantErr: "is not an IP address",
+		},
+		{
+			name:    "missing host",
+			input:   "=10.0.0.5",
+			wantErr: "missing host",
+		},
+		{
+			name:    "hosts file line without host",
+			input:   "10.0.0.5",
+			wantErr: "missing host",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			overrides, err := parseOverrides(test.input)
+			if test.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+					t.Fatalf("parseOverrides(%q) error = %v, want %q", test.input, err, test.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseOverrides(%q) error = %v", test.input, err)
+			}
+
+			got := make(map[string][]string)
+			for host, ips := range overrides {
+				for _, ip := range ips {
+					got[host] = append(got[host], ip.String())
+				}
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("parseOverrides(%q) = %v, want %v", test.input, got, test.want)
+			}
+		})
+	}
+}
+
+func TestSetOverrides(t *testing.T) {
+	resolutions.lock.Lock()
+	resolutions.overrides = map[string][]net.IP{"a.corp": {net.ParseIP("10.0.0.1")}, "b.corp": {net.ParseIP("10.0.0.2")}}
+	resolutions.byHost = make(map[string]*resolution)
+	for _, host := range []string{"a.corp", "b.corp", "c.corp", "d.corp"} {
+		resolutions.byHost[host] = &resolution{resolved: true}
+	}
+	resolutions.lock.Unlock()
+	t.Cleanup(func() {
+		resolutions.lock.Lock()
+		resolutions.overrides, resolutions.byHost = nil, make(map[string]*resolution)
+		resolutions.lock.Unlock()
+	})
+
+	// a.corp keeps its override, b.corp changes, c.corp gets one and d.corp is untouched.
+	setOverrides(map[string][]net.IP{
+		"a.corp": {net.ParseIP("10.0.0.1")},
+		"b.corp": {net.ParseIP("10.0.0.3")},
+		"c.corp": {net.ParseIP("10.0.0.4")},
+	})
+
+	resolutions.lock.Lock()
+	var cached []string
+	for host := range resolutions.byHost {
+		cached = append(cached, host)
+	}
+	resolutions.lock.Unlock()
+	sort.Strings(cached)
+
+	if want := []string{"a.corp", "d.corp"}; !reflect.DeepEqual(cached, want) {
+		t.Errorf("cached hosts = %v, want %v", cached, want)
+	}
+}
+
+func TestTTLRange(t *testing.T) {
+	bounds := ttlRange{min: 30 * time.Second, max: 10 * time.Minute}
+
+	clampTests := []struct {
+		ttl  time.Duration
+		want time.Duration
+	}{
+		{ttl: 0, want: 30 * time.Second},
+		{ttl: 5 * time.Second, want: 30 * time.Second},
+		{ttl: 30 * time.Second, want: 30 * time.Second},
+		{ttl: 2 * time.Minute, want: 2 * time.Minute},
+		{ttl: 10 * time.Minute, want: 10 * time.Minute},
+		{ttl: 24 * time.Hour, want: 10 * time.Minute},
+	}
+	for _, test := range clampTests {
+		if got := bounds.clamp(test.ttl); got != test.want {
+			t.Errorf("clamp(%s) = %s, want %s", test.ttl, got, test.want)
+		}
+	}
+
+	backoffTests := []struct {
+		failures int
+		want     time.Duration
+	}{
+		{failures: 1, want: firstResolveBackoff},
+		{failures: 2, want: 2 * firstResolveBackoff},
+		{failures: 3, want: 4 * firstResolveBackoff},
+		{failures: 7, want: 320 * time.Second},
+		{failures: 8, want: 10 * time.Minute},
+		{failures: 1000, want: 10 * time.Minute},
+	}
+	for _, test := range backoffTests {
+		if got := bounds.backoff(test.failures); got != test.want {
+			t.Errorf("backoff(%d) = %s, want %s", test.failures, got, test.want)
+		}
+	}
+
+	// The backoff never exceeds a maximum below the first delay.
+	short := ttlRange{min: time.Second, max: 2 * time.Second}
+	if got := short.backoff(1); got != 2*time.Second {
+		t.Errorf("backoff(1) with a maximum of 2s = %s, want 2s", got)
+	}
+}
@@ -0,0 +1,189 @@
+package mapping
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/spf13/viper"
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv4"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv6"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+
+	"wiretap/transport"
+)
+
+// Reverse lets internal systems reach a service on the gateway side: the agent listens on a port of its
+// host and forwards every connection through the tunnel to Remote.
+type Reverse struct {
+	// Listen is the host address the agent listens on, such as ":8443" or "127.0.0.1:8443".
+	Listen string
+	// Remote is the address of the service in the tunnel.
+	Remote netip.AddrPort
+}
+
+func (r Reverse) String() string {
+	return fmt.Sprintf("%s=%s", r.Listen, r.Remote)
+}
+
+// REVERSE: "8443=443,127.0.0.1:8081=10.9.0.1:8081,[::1]:9000=[fd00::1]:9000"
+// The listen address defaults to every address of the host, the remote address to the tunnel address of the gateway.
+func parseReverse(input string) ([]Reverse, error) {
+	var result []Reverse
+	listening := make(map[string]bool)
+
+	for _, entry := range strings.Split(input, ",") {
+		entry = strings.TrimSpace(entry)
+		if len(entry) == 0 {
+			continue
+		}
+
+		listen, remote, found := strings.Cut(entry, "=")
+		if !found {
+			return nil, fmt.Errorf("invalid reverse mapping '%s', expected listen=remote", entry)
+		}
+
+		reverse, err := parseReverseEntry(strings.TrimSpace(listen), strings.TrimSpace(remote))
+		if err != nil {
+			return nil, fmt.Errorf("invalid reverse mapping '%s': %w", entry, err)
+		}
+		if listening[reverse.Listen] {
+			return nil, fmt.Errorf("duplicate reverse mapping of %s", reverse.Listen)
+		}
+		listening[reverse.Listen] = true
+		result = append(result, reverse)
+	}
+
+	return result, nil
+}
+
+func parseReverseEntry(listen string, remote string) (Reverse, error) {
+	if !strings.Contains(listen, ":") {
+		listen = ":" + listen
+	}
+	host, port, err := net.SplitHostPort(listen)
+	if err != nil {
+		return Reverse{}, err
+	}
+	if number, err := strconv.ParseUint(port, 10, 16); err != nil || number == 0 {
+		return Reverse{}, fmt.Errorf("invalid listen port '%s'", port)
+	}
+	if host != "" && net.ParseIP(host) == nil {
+		return Reverse{}, fmt.Errorf("invalid listen address '%s'", host)
+	}
+
+	var remoteAddr netip.AddrPort
+	if number, err := strconv.ParseUint(remote, 10, 16); err == nil {
+		gateway, err := gatewayAddr()
+		if err != nil {
+			return Reverse{}, err
+		}
+		remoteAddr = netip.AddrPortFrom(gateway, uint16(number))
+	} else if remoteAddr, err = netip.ParseAddrPort(remote); err != nil {
+		return Reverse{}, fmt.Errorf("invalid remote address '%s', expected ip:port or a port of the gateway", remote)
+	}
+	remoteAddr = netip.AddrPortFrom(remoteAddr.Addr().Unmap(), remoteAddr.Port())
+
+	if remoteAddr.Port() == 0 {
+		return Reverse{}, errors.New("invalid remote port 0")
+	}
+	if remoteAddr.Addr().Is6() && viper.IsSet("disableipv6") {
+		return Reverse{}, fmt.Errorf("remote %s is IPv6, which is disabled", remoteAddr.Addr())
+	}
+	if !inTunnel(remoteAddr.Addr()) {
+		return Reverse{}, fmt.Errorf("remote %s is outside of the allowed IPs of the tunnel peer", remoteAddr.Addr())
+	}
+
+	return Reverse{Listen: net.JoinHostPort(host, port), Remote: remoteAddr}, nil
+}
+
+// peerPrefixes returns the allowed IPs of the relay peer, the addresses reachable through the tunnel.
+func peerPrefixes() []netip.Prefix {
+	var prefixes []netip.Prefix
+	for _, allowed := range strings.Split(viper.GetString("Relay.Peer.allowed"), ",") {
+		if prefix, err := netip.ParsePrefix(strings.TrimSpace(allowed)); err == nil {
+			prefixes = append(prefixes, prefix)
+		}
+	}
+	return prefixes
+}
+
+// gatewayAddr returns the tunnel address of the gateway, the first single address allowed for the relay peer.
+func gatewayAddr() (netip.Addr, error) {
+	for _, prefix := range peerPrefixes() {
+		if prefix.IsSingleIP() {
+			return prefix.Addr(), nil
+		}
+	}
+	return netip.Addr{}, errors.New("the allowed IPs of the tunnel peer have no single address, give the remote address")
+}
+
+func inTunnel(addr netip.Addr) bool {
+	for _, prefix := range peerPrefixes() {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// reverseListeners are the host listeners of the applied reverse mappings.
+var reverseListeners = struct {
+	lock      sync.Mutex
+	listeners map[Reverse]net.Listener
+}{listeners: make(map[Reverse]net.Listener)}
+
+// applyReverse starts listening for the reverse mappings that are not yet listening and stops the ones that were
+// removed. Established connections are kept. It returns the mappings that could not listen.
+func applyReverse(s *stack.Stack, mappings []Reverse) error {
+	reverseListeners.lock.Lock()
+	defer reverseListeners.lock.Unlock()
+
+	wanted := make(map[Reverse]bool)
+	for _, reverse := range mappings {
+		wanted[reverse] = true
+	}
+	for reverse, listener := range reverseListeners.listeners {
+		if !wanted[reverse] {
+			listener.Close()
+			delete(reverseListeners.listeners, reverse)
+			log.Printf("Stopped reverse mapping %s -> %s\n", reverse.Listen, reverse.Remote)
+		}
+	}
+
+	var errs []error
+	for _, reverse := range mappings {
+		if _, ok := reverseListeners.listeners[reverse]; ok {
+			continue
+		}
+
+		listener, err := net.Listen("tcp", reverse.Listen)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("reverse mapping %s: %w", reverse, err))
+			continue
+		}
+		reverseListeners.listeners[reverse] = listener
+
+		var netProto tcpip.NetworkProtocolNumber = ipv4.ProtocolNumber
+		if reverse.Remote.Addr().Is6() {
+			netProto = ipv6.ProtocolNumber
+		}
+		// The source address is picked by the route to the remote address.
+		go transport.ForwardTcpPort(
+			s,
+			listener,
+			tcpip.FullAddress{NIC: 1},
+			tcpip.FullAddress{NIC: 1, Addr: tcpip.AddrFromSlice(reverse.Remote.Addr().AsSlice()), Port: reverse.Remote.Port()},
+			netProto,
+		)
+		log.Printf("Reverse mapping %s -> %s\n", reverse.Listen, reverse.Remote)
+	}
+
+	return errors.Join(errs...)
+}
@@ -0,0 +1,72 @@
+package mapping
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/spf13/viper"
+)
+
+func TestParseReverse(t *testing.T) {
+	viper.Set("Relay.Peer.allowed", "10.9.0.0/16, 10.9.0.1/32, fd00::/64")
+	t.Cleanup(func() { viper.Set("Relay.Peer.allowed", "") })
+
+	tests := []struct {
+		name     string
+		input    string
+		allowed  string
+		want     []string
+		wantErr  string
+		disable6 bool
+	}{
+		{name: "empty", input: " , "},
+		{name: "port of the gateway", input: "8443=443", want: []string{":8443=10.9.0.1:443"}},
+		{name: "listen address", input: "127.0.0.1:8081=10.9.0.7:8081", want: []string{"127.0.0.1:8081=10.9.0.7:8081"}},
+		{name: "ipv6", input: "[::1]:9000=[fd00::1]:9000", want: []string{"[::1]:9000=[fd00::1]:9000"}},
+		{name: "mapped ipv4 remote", input: "9000=[::ffff:10.9.0.7]:9000", want: []string{":9000=10.9.0.7:9000"}},
+		{name: "several", input: "8443=443, 127.0.0.1:8443=10.9.0.7:443", want: []string{":8443=10.9.0.1:443", "127.0.0.1:8443=10.9.0.7:443"}},
+		{name: "missing remote", input: "8443", wantErr: "expected listen=remote"},
+		{name: "invalid listen port", input: "http=443", wantErr: "invalid listen port"},
+		{name: "listen port 0", input: "0=443", wantErr: "invalid listen port"},
+		{name: "listen host name", input: "localhost:8443=443", wantErr: "invalid listen address"},
+		{name: "invalid remote", input: "8443=gateway:443", wantErr: "invalid remote address"},
+		{name: "remote port 0", input: "8443=10.9.0.7:0", wantErr: "invalid remote port"},
+		{name: "remote outside of the tunnel", input: "8443=192.168.0.1:443", wantErr: "outside of the allowed IPs"},
+		{name: "duplicate listen address", input: "8443=443,:8443=10.9.0.7:443", wantErr: "duplicate reverse mapping"},
+		{name: "no gateway address", input: "8443=443", allowed: "10.9.0.0/16", wantErr: "no single address"},
+		{name: "ipv6 disabled", input: "9000=[fd00::1]:9000", disable6: true, wantErr: "IPv6, which is disabled"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if test.allowed != "" {
+				viper.Set("Relay.Peer.allowed", test.allowed)
+				defer viper.Set("Relay.Peer.allowed", "10.9.0.0/16, 10.9.0.1/32, fd00::/64")
+			}
+			if test.disable6 {
+				viper.Set("disableipv6", true)
+				defer viper.Set("disableipv6", nil)
+			}
+
+			reverse, err := parseReverse(test.input)
+			if test.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+					t.Fatalf("parseReverse(%q) error = %v, want %q", test.input, err, test.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseReverse(%q) error = %v", test.input, err)
+			}
+
+			var got []string
+			for _, r := range reverse {
+				got = append(got, r.String())
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("parseReverse(%q) = %v, want %v", test.input, got, test.want)
+			}
+		})
+	}
+}
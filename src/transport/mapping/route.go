@@ -0,0 +1,166 @@
+package mapping
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+
+	"gvisor.dev/gvisor/pkg/tcpip"
+)
+
+// Routing selects the backend of each connection to a routed mapping by a name the client sends.
+type Routing string
+
+const (
+	// RoutingSNI routes TLS connections by the server name of their ClientHello, without terminating TLS.
+	RoutingSNI Routing = "sni"
+	// RoutingHTTP routes plaintext HTTP requests by their Host header.
+	RoutingHTTP Routing = "http"
+)
+
+// defaultRoute is the name of the route taken by names that no other route matches.
+const defaultRoute = "*"
+
+// Route sends the connections of a routed mapping for a name to a backend.
+type Route struct {
+	// Name is a host name, "*.domain" for every name under domain, or "*" for every other name.
+	Name    string
+	Backend string
+	// Port is the backend port. It defaults to the backend port of the mapped port.
+	Port uint16
+}
+
+func (r Route) String() string {
+	backend := r.Backend
+	if r.Port != 0 {
+		backend = net.JoinHostPort(r.Backend, fmt.Sprint(r.Port))
+	}
+	return fmt.Sprintf("%s=%s", r.Name, backend)
+}
+
+// parseRoute parses the backend of a route, a host with an optional port, such as gitlab.internal:8443 or [fd00::7]:443.
+func parseRoute(name string, backend string) (Route, error) {
+	name = strings.TrimSuffix(strings.ToLower(strings.TrimSpace(name)), ".")
+	backend = strings.TrimSpace(backend)
+	if name == "" || backend == "" {
+		return Route{}, fmt.Errorf("route '%s' needs a name and a backend", name)
+	}
+	if strings.Contains(name, "*") && name != defaultRoute && (!strings.HasPrefix(name, "*.") || strings.Count(name, "*") > 1) {
+		return Route{}, fmt.Errorf("invalid route name '%s', wildcards must be '*' or '*.domain'", name)
+	}
+
+	route := Route{Name: name, Backend: backend}
+	if host, port, err := net.SplitHostPort(backend); err == nil {
+		number, err := strconv.ParseUint(port, 10, 16)
+		if err != nil || number == 0 {
+			return Route{}, fmt.Errorf("invalid port in backend '%s' of route '%s'", backend, name)
+		}
+		route.Backend, route.Port = host, uint16(number)
+	} else if strings.HasPrefix(backend, "[") && strings.HasSuffix(backend, "]") {
+		route.Backend = strings.Trim(backend, "[]")
+	}
+	return route, nil
+}
+
+// matchRoute returns the route of a name: the route of the name itself, then of the longest wildcard
+// it falls under, then the default route.
+func matchRoute(routes []Route, name string) (Route, bool) {
+	name = strings.TrimSuffix(strings.ToLower(name), ".")
+
+	var best Route
+	found := false
+	for _, route := range routes {
+		switch {
+		case route.Name == name && name != "":
+			return route, true
+		case strings.HasPrefix(route.Name, "*.") && strings.HasSuffix(name, route.Name[1:]):
+			if !found || best.Name == defaultRoute || len(route.Name) > len(best.Name) {
+				best, found = route, true
+			}
+		case route.Name == defaultRoute && !found:
+			best, found = route, true
+		}
+	}
+	return best, found
+}
+
+// address returns the backend address of a connection to a mapped port routed by r.
+func (r Route) address(port Port) (string, error) {
+	ip4, ip6, err := resolveIP(r.Backend)
+	if err != nil {
+		return "", err
+	}
+	ip := ip4
+	if ip == nil {
+		ip = ip6
+	}
+
+	backendPort := r.Port
+	if backendPort == 0 {
+		backendPort = port.backendPort(port.Number)
+	}
+	return net.JoinHostPort(ip.String(), fmt.Sprint(backendPort)), nil
+}
+
+// BackendHosts returns the hosts the backends of a mapping resolve from.
+func (m HostMapping) BackendHosts() []string {
+	if len(m.Backends) > 0 {
+		return m.Backends
+	}
+	if m.Routing != "" {
+		hosts := make([]string, 0, len(m.Routes))
+		for _, route := range m.Routes {
+			hosts = append(hosts, route.Backend)
+		}
+		return hosts
+	}
+	return []string{m.Host}
+}
+
+// routedTargets gives a routed mapping its mapped addresses. Routed mappings have no single backend, their
+// connections are routed by a proxy, so the host itself is not resolved. The names of the routes that are not
+// wildcards resolve to the mapped addresses too.
+func routedTargets(mapping HostMapping, mappingPrefix netip.Prefix, mappingPrefix6 netip.Prefix, names *nameTable) ([]target, []target) {
+	// Backends are resolved ahead of connections, so that they are known to the upstream dialer and reported.
+	for _, route := range mapping.Routes {
+		resolveIP(route.Backend)
+	}
+
+	var targets4, targets6 []target
+	if mappedIp, err := mappedAddr(mappingPrefix, mapping.Order); err != nil {
+		log.Println("Unable to map IP", mapping.Host, err)
+	} else {
+		targets4 = append(targets4, target{
+			mapped: tcpip.AddrFrom4(mappedIp.As4()),
+			bits:   32,
+			ports:  mapping.Ports,
+		})
+		addRouteNames(names, mapping, mappedIp)
+	}
+
+	if mappingPrefix6.IsValid() {
+		if mappedIp6, err := mappedAddr(mappingPrefix6, mapping.Order); err != nil {
+			log.Println("Unable to map IPv6", mapping.Host, err)
+		} else {
+			targets6 = append(targets6, target{
+				mapped: tcpip.AddrFrom16(mappedIp6.As16()),
+				bits:   128,
+				ports:  mapping.Ports,
+			})
+			addRouteNames(names, mapping, mappedIp6)
+		}
+	}
+	return targets4, targets6
+}
+
+func addRouteNames(names *nameTable, mapping HostMapping, mapped netip.Addr) {
+	names.add(mapping.Host, mapped)
+	for _, route := range mapping.Routes {
+		if !strings.Contains(route.Name, "*") {
+			names.add(route.Name, mapped)
+		}
+	}
+}
@@ -0,0 +1,42 @@
+package mapping
+
+import "testing"
+
+func TestMatchRoute(t *testing.T) {
+	routes := []Route{
+		{Name: "*.corp", Backend: "corp-gateway"},
+		{Name: "git.corp", Backend: "gitlab"},
+		{Name: "*.dev.corp", Backend: "dev-gateway"},
+		{Name: defaultRoute, Backend: "fallback"},
+	}
+
+	tests := []struct {
+		name        string
+		routes      []Route
+		serverName  string
+		wantBackend string
+		wantOK      bool
+	}{
+		{name: "exact name", routes: routes, serverName: "git.corp", wantBackend: "gitlab", wantOK: true},
+		{name: "case and trailing dot", routes: routes, serverName: "Git.Corp.", wantBackend: "gitlab", wantOK: true},
+		{name: "wildcard", routes: routes, serverName: "jira.corp", wantBackend: "corp-gateway", wantOK: true},
+		{name: "longest wildcard", routes: routes, serverName: "ci.dev.corp", wantBackend: "dev-gateway", wantOK: true},
+		{name: "longest wildcard listed first", routes: []Route{routes[2], routes[0]}, serverName: "ci.dev.corp", wantBackend: "dev-gateway", wantOK: true},
+		{name: "wildcard before default", routes: []Route{routes[3], routes[0]}, serverName: "jira.corp", wantBackend: "corp-gateway", wantOK: true},
+		{name: "wildcard does not match its domain", routes: routes[:1], serverName: "corp"},
+		{name: "wildcard does not match a suffix", routes: routes[:1], serverName: "notcorp"},
+		{name: "default", routes: routes, serverName: "example.com", wantBackend: "fallback", wantOK: true},
+		{name: "no server name", routes: routes, serverName: "", wantBackend: "fallback", wantOK: true},
+		{name: "no server name without default", routes: routes[:3], serverName: ""},
+		{name: "no route", routes: routes[:3], serverName: "example.com"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			route, ok := matchRoute(test.routes, test.serverName)
+			if ok != test.wantOK || route.Backend != test.wantBackend {
+				t.Errorf("matchRoute(%q) = %+v, %v, want backend %q, %v", test.serverName, route, ok, test.wantBackend, test.wantOK)
+			}
+		})
+	}
+}
@@ -5,53 +5,246 @@ import (
 	"crypto/tls"
 	"encoding/json"
 	"fmt"
+	"io"
 	"log"
 	"net/http"
+	"net/netip"
+	"sync"
+	"time"
 
 	"github.com/spf13/viper"
 )
 
 type HostConfigurationRequest struct {
-	MappedOrder int
-	Host        string
+	MappedOrder    int
+	Host           string
+	MappedAddress  string
+	MappedAddress6 string `json:",omitempty"`
+	// Subnet mappings report the backend subnet and the slice of the mapping prefix it is mapped onto.
+	Subnet       string `json:",omitempty"`
+	MappedSubnet string `json:",omitempty"`
+	// Wildcard is set for hosts mapped on demand, it is the wildcard entry they fall under.
+	Wildcard string `json:",omitempty"`
+	// Balance and Backends are set for load balanced hosts.
+	Balance  string   `json:",omitempty"`
+	Backends []string `json:",omitempty"`
+	// TLS is set when the agent connects to the backend over TLS, clients of the mapping use plaintext.
+	TLS bool `json:",omitempty"`
+	// Routing and Routes are set for hosts whose mapped address is shared by the backends of their routes.
+	Routing string         `json:",omitempty"`
+	Routes  []RouteRequest `json:",omitempty"`
+	// Proxy is the proxy the backends are connected to through when it overrides the upstream proxy, without
+	// credentials, or "direct".
+	Proxy string `json:",omitempty"`
+	Ports []PortRequest
+	// Resolution is how the host resolved on the agent: literal, override, resolved, stale, failed or pending.
+	Resolution        string   `json:",omitempty"`
+	ResolvedAddresses []string `json:",omitempty"`
+	ResolutionError   string   `json:",omitempty"`
+	// Name, Kind and Labels describe the host for display.
+	Name   string            `json:",omitempty"`
+	Kind   string            `json:",omitempty"`
+	Labels map[string]string `json:",omitempty"`
 }
 
 type NetworkBrokerConfigurationRequest struct {
-	Hosts        []HostConfigurationRequest
-	MappedPrefix string
+	ManifestVersion int
+	// Revision is a hash of the rest of the manifest. Sending a revision again changes nothing.
+	Revision      string
+	AgentVersion  string `json:",omitempty"`
+	Hosts         []HostConfigurationRequest
+	MappedPrefix  string
+	MappedPrefix6 string `json:",omitempty"`
+	// DNSAddress is where mapped hostnames can be resolved, if the DNS responder is enabled.
+	DNSAddress string `json:",omitempty"`
+	// Wildcards are the wildcard entries, whose names are mapped on demand through the DNS responder.
+	Wildcards []string `json:",omitempty"`
 }
 
-func SendConfig(hostsMapping []HostMapping, mappingPrefix string) {
-	domain := viper.GetString("Apiiro.Domain")
-	accessToken := viper.GetString("Config.Token")
+// HostStatusRequest is the reachability of a backend port of a mapped host, as last probed by the agent.
+type HostStatusRequest struct {
+	Host            string
+	Backend         string
+	ResolvedAddress string `json:",omitempty"`
+	Port            uint16
+	Up              bool
+	LatencyMs       float64
+	LastError       string `json:",omitempty"`
+	CheckedAt       time.Time
+}
+
+type NetworkBrokerStatusRequest struct {
+	Hosts []HostStatusRequest
+}
 
+// SendConfig queues the manifest of the mappings to be sent to the server, unless it is the last one sent.
+func SendConfig(hostsMapping []HostMapping, mappingPrefix netip.Prefix, mappingPrefix6 netip.Prefix) {
 	hosts := []HostConfigurationRequest{}
-	for i, host := range hostsMapping {
-		hosts = append(hosts, HostConfigurationRequest{
+	for _, host := range hostsMapping {
+		hostRequest := HostConfigurationRequest{
 			Host:        host.Host,
-			MappedOrder: i + 1,
-		})
+			MappedOrder: host.Order,
+			Wildcard:    host.Wildcard,
+			Balance:     string(host.Balance),
+			Backends:    host.Backends,
+			TLS:         host.TLS != nil,
+			Routing:     string(host.Routing),
+			Routes:      routeRequests(host.Routes),
+			Proxy:       redactedProxy(host.Proxy),
+			Ports:       portRequests(host.Ports),
+			Name:        host.Name,
+			Kind:        serviceKind(host),
+			Labels:      host.Labels,
+		}
+		hostRequest.Resolution, hostRequest.ResolvedAddresses, hostRequest.ResolutionError = hostResolution(host)
+		if host.Subnet.IsValid() {
+			prefix := mappingPrefix
+			if host.Subnet.Addr().Is6() {
+				prefix = mappingPrefix6
+			}
+			hostRequest.Subnet = host.Subnet.String()
+			if mappedSubnet, err := host.mappedSubnet(prefix); err == nil {
+				hostRequest.MappedSubnet = mappedSubnet.String()
+				if mappedSubnet.Addr().Is6() {
+					hostRequest.MappedAddress6 = mappedSubnet.Addr().String()
+				} else {
+					hostRequest.MappedAddress = mappedSubnet.Addr().String()
+				}
+			}
+			hosts = append(hosts, hostRequest)
+			continue
+		}
+		if addr, err := mappedAddr(mappingPrefix, host.Order); err == nil {
+			hostRequest.MappedAddress = addr.String()
+		}
+		if mappingPrefix6.IsValid() {
+			if addr, err := mappedAddr(mappingPrefix6, host.Order); err == nil {
+				hostRequest.MappedAddress6 = addr.String()
+			}
+		}
+		hosts = append(hosts, hostRequest)
 	}
 
 	configRequest := NetworkBrokerConfigurationRequest{
-		Hosts:        hosts,
-		MappedPrefix: mappingPrefix,
+		ManifestVersion: ManifestVersion,
+		AgentVersion:    AgentVersion,
+		Hosts:           hosts,
+		MappedPrefix:    mappingPrefix.String(),
 	}
+	if mappingPrefix6.IsValid() {
+		configRequest.MappedPrefix6 = mappingPrefix6.String()
+	}
+	if dnsAddress.IsValid() {
+		configRequest.DNSAddress = dnsAddress.String()
+	}
+	configRequest.Wildcards = onDemandWildcards()
+	configRequest.Revision = manifestRevision(configRequest)
 
-	err := sendRequest(fmt.Sprintf("https://%s/rest-api/v1.0/broker/configuration", domain), accessToken, configRequest)
-	if err != nil {
-		log.Println("Error sending config:", err)
+	queueConfig(configRequest)
+}
+
+const (
+	firstSendBackoff = time.Second
+	maxSendBackoff   = 5 * time.Minute
+)
+
+// sendBackoff returns the delay before sending again a request that failed attempt times in a row.
+func sendBackoff(attempt int) time.Duration {
+	delay := firstSendBackoff
+	for i := 1; i < attempt && delay < maxSendBackoff; i++ {
+		delay *= 2
+	}
+	if delay > maxSendBackoff {
+		return maxSendBackoff
+	}
+	return delay
+}
+
+// statusSync holds the probe statuses waiting to be sent. Only the latest statuses are worth sending.
+var statusSync = struct {
+	lock    sync.Mutex
+	pending *NetworkBrokerStatusRequest
+	wake    chan struct{}
+}{wake: make(chan struct{}, 1)}
+
+// SendStatus queues the reachability of the mapped hosts, replacing statuses not sent yet.
+func SendStatus(statuses []ProbeStatus) {
+	request := statusRequest(statuses)
+
+	statusSync.lock.Lock()
+	statusSync.pending = &request
+	statusSync.lock.Unlock()
+
+	select {
+	case statusSync.wake <- struct{}{}:
+	default:
+	}
+}
+
+// syncStatuses sends the queued statuses to the server. They are retried with exponential backoff until
+// the server acknowledges them with a 2xx, or newer statuses replace them.
+func syncStatuses() {
+	for range statusSync.wake {
+		attempt := 0
+		for {
+			statusSync.lock.Lock()
+			request := statusSync.pending
+			statusSync.lock.Unlock()
+			if request == nil {
+				break
+			}
+
+			attempt++
+			endpoint := fmt.Sprintf("https://%s/rest-api/v1.0/broker/status", viper.GetString("Apiiro.Domain"))
+			err := sendRequest(endpoint, viper.GetString("Config.Token"), "Status", *request)
+			if err == nil {
+				statusSync.lock.Lock()
+				if statusSync.pending == request {
+					statusSync.pending = nil
+				}
+				statusSync.lock.Unlock()
+				attempt = 0
+				continue
+			}
+
+			delay := sendBackoff(attempt)
+			log.Printf("Error sending status, retrying in %s (attempt %d): %v\n", delay, attempt, err)
+			select {
+			case <-time.After(delay):
+			case <-statusSync.wake:
+				// Newer statuses are sent right away.
+				attempt = 0
+			}
+		}
 	}
 }
 
-func sendRequest(endpoint, accessToken string, data NetworkBrokerConfigurationRequest) error {
+func statusRequest(statuses []ProbeStatus) NetworkBrokerStatusRequest {
+	hosts := []HostStatusRequest{}
+	for _, status := range statuses {
+		hosts = append(hosts, HostStatusRequest{
+			Host:            status.Host,
+			Backend:         status.Backend,
+			ResolvedAddress: status.Address,
+			Port:            status.Port,
+			Up:              status.Up,
+			LatencyMs:       float64(status.Latency.Microseconds()) / 1000,
+			LastError:       status.LastError,
+			CheckedAt:       status.CheckedAt,
+		})
+	}
+	return NetworkBrokerStatusRequest{Hosts: hosts}
+}
+
+// sendRequest puts data to endpoint as JSON, kind names the payload in the log.
+func sendRequest(endpoint, accessToken, kind string, data any) error {
 	// Prepare request
 	jsonData, err := json.Marshal(data)
 	if err != nil {
 		return err
 	}
 
-	log.Println("Config Json", string(jsonData))
+	log.Println(kind+" Json", string(jsonData))
 
 	req, err := http.NewRequest(http.MethodPut, endpoint, bytes.NewBuffer(jsonData))
 	if err != nil {
@@ -78,5 +271,9 @@ func sendRequest(endpoint, accessToken string, data NetworkBrokerConfigurationRe
 
 	// Handle response
 	log.Println("Response Status:", resp.Status)
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("server answered %s: %s", resp.Status, bytes.TrimSpace(body))
+	}
 	return nil
 }
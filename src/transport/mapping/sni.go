@@ -0,0 +1,98 @@
+package mapping
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"time"
+
+	"github.com/spf13/viper"
+
+	"wiretap/transport"
+)
+
+// clientHelloTimeout bounds the wait for the ClientHello of a connection routed by SNI.
+const clientHelloTimeout = 10 * time.Second
+
+// errClientHelloRead stops the handshake used to read a ClientHello once it is parsed.
+var errClientHelloRead = errors.New("client hello read")
+
+// helloConn is the side of a connection a ClientHello is read from. Reads are recorded so that they can
+// be replayed to the backend, and nothing is ever written to the client.
+type helloConn struct {
+	net.Conn
+	reader io.Reader
+}
+
+func (c helloConn) Read(b []byte) (int, error) {
+	return c.reader.Read(b)
+}
+
+func (c helloConn) Write(b []byte) (int, error) {
+	return 0, io.ErrClosedPipe
+}
+
+// readServerName reads the ClientHello of a TLS connection. It returns the server name it asks for, empty
+// when it sends none, and every byte read from the connection.
+func readServerName(conn net.Conn) (string, []byte, error) {
+	var read bytes.Buffer
+	var hello *tls.ClientHelloInfo
+	err := tls.Server(helloConn{Conn: conn, reader: io.TeeReader(conn, &read)}, &tls.Config{
+		GetConfigForClient: func(info *tls.ClientHelloInfo) (*tls.Config, error) {
+			hello = info
+			return nil, errClientHelloRead
+		},
+	}).Handshake()
+	if hello == nil {
+		return "", nil, err
+	}
+	return hello.ServerName, read.Bytes(), nil
+}
+
+// sniHandler serves the connections to a port of a mapping routed by SNI. The ClientHello is read to pick the
+// route, then replayed to its backend, and the connection is spliced without terminating TLS. Connections
+// for names without a route are reset.
+func sniHandler(mapping HostMapping, port Port) proxyHandler {
+	return func(conn *proxyConn) {
+		conn.SetReadDeadline(time.Now().Add(clientHelloTimeout))
+		name, hello, err := readServerName(conn)
+		if err != nil {
+			if viper.GetBool("verbose") {
+				log.Printf("No TLS ClientHello on %s:%d: %v\n", mapping.Host, port.Number, err)
+			}
+			conn.reset()
+			return
+		}
+		conn.SetReadDeadline(time.Time{})
+
+		route, ok := matchRoute(mapping.Routes, name)
+		if !ok {
+			log.Printf("No route for server name '%s' on %s:%d\n", name, mapping.Host, port.Number)
+			conn.reset()
+			return
+		}
+
+		address, err := route.address(port)
+		if err != nil {
+			log.Printf("Unable to resolve %s for server name '%s' on %s: %v\n", route.Backend, name, mapping.Host, err)
+			conn.reset()
+			return
+		}
+		dst, err := dialBackend(address)
+		if err != nil {
+			log.Printf("Unable to connect to %s for server name '%s' on %s: %v\n", address, name, mapping.Host, err)
+			conn.reset()
+			return
+		}
+		if _, err := dst.Write(hello); err != nil {
+			dst.Close()
+			conn.Close()
+			return
+		}
+
+		transport.Proxy(conn, dst)
+	}
+}
@@ -0,0 +1,77 @@
+package mapping
+
+import (
+	"bytes"
+	"crypto/tls"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// clientHello returns the first record a TLS client sends for serverName.
+func clientHello(t *testing.T, serverName string) []byte {
+	t.Helper()
+
+	client, server := net.Pipe()
+	defer server.Close()
+	go tls.Client(client, &tls.Config{ServerName: serverName, InsecureSkipVerify: true}).Handshake()
+	defer client.Close()
+
+	server.SetReadDeadline(time.Now().Add(5 * time.Second))
+	header := make([]byte, 5)
+	if _, err := io.ReadFull(server, header); err != nil {
+		t.Fatal(err)
+	}
+	record := make([]byte, int(header[3])<<8|int(header[4]))
+	if _, err := io.ReadFull(server, record); err != nil {
+		t.Fatal(err)
+	}
+	return append(header, record...)
+}
+
+func TestReadServerName(t *testing.T) {
+	hello := clientHello(t, "git.corp")
+	helloWithoutName := clientHello(t, "")
+
+	tests := []struct {
+		name     string
+		data     []byte
+		wantName string
+		wantErr  bool
+	}{
+		{name: "server name", data: hello, wantName: "git.corp"},
+		{name: "no server name", data: helloWithoutName, wantName: ""},
+		{name: "truncated record", data: hello[:len(hello)/2], wantErr: true},
+		{name: "truncated header", data: hello[:3], wantErr: true},
+		{name: "empty", data: nil, wantErr: true},
+		{name: "not TLS", data: []byte("GET / HTTP/1.1\r\nHost: git.corp\r\n\r\n"), wantErr: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			client, server := net.Pipe()
+			defer server.Close()
+			go func() {
+				client.Write(test.data)
+				client.Close()
+			}()
+
+			server.SetReadDeadline(time.Now().Add(5 * time.Second))
+			name, read, err := readServerName(server)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("readServerName() error = %v, want error %v", err, test.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if name != test.wantName {
+				t.Errorf("readServerName() = %q, want %q", name, test.wantName)
+			}
+			// Every byte read is replayed to the backend, the ClientHello must come back whole.
+			if !bytes.Equal(read, test.data) {
+				t.Errorf("readServerName() read %d bytes, want the %d bytes of the ClientHello", len(read), len(test.data))
+			}
+		})
+	}
+}
@@ -0,0 +1,115 @@
+package mapping
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// configSync holds the manifest waiting to be acknowledged by the server and the last acknowledged revision.
+var configSync = struct {
+	lock     sync.Mutex
+	pending  *NetworkBrokerConfigurationRequest
+	synced   string
+	syncedAt time.Time
+	wake     chan struct{}
+}{wake: make(chan struct{}, 1)}
+
+// manifestRevision hashes a manifest. Lookup errors are left out, their wording changes between attempts
+// without the mapping changing.
+func manifestRevision(request NetworkBrokerConfigurationRequest) string {
+	request.Revision = ""
+	request.Hosts = append([]HostConfigurationRequest(nil), request.Hosts...)
+	for i := range request.Hosts {
+		request.Hosts[i].ResolutionError = ""
+	}
+
+	data, err := json.Marshal(request)
+	if err != nil {
+		return ""
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:16])
+}
+
+// queueConfig replaces the manifest waiting to be sent, unless the server already has its revision.
+func queueConfig(request NetworkBrokerConfigurationRequest) {
+	configSync.lock.Lock()
+	defer configSync.lock.Unlock()
+
+	if configSync.pending != nil && configSync.pending.Revision == request.Revision {
+		return
+	}
+	if configSync.pending == nil && configSync.synced == request.Revision {
+		if viper.GetBool("verbose") {
+			log.Println("Config revision is up to date", request.Revision)
+		}
+		return
+	}
+
+	configSync.pending = &request
+	select {
+	case configSync.wake <- struct{}{}:
+	default:
+	}
+}
+
+// SyncConfig sends the queued manifests to the server. A manifest is retried with exponential backoff
+// until the server acknowledges it with a 2xx, or a newer manifest replaces it.
+func SyncConfig() {
+	for range configSync.wake {
+		attempt := 0
+		for {
+			configSync.lock.Lock()
+			request := configSync.pending
+			configSync.lock.Unlock()
+			if request == nil {
+				break
+			}
+
+			attempt++
+			endpoint := fmt.Sprintf("https://%s/rest-api/v1.0/broker/configuration", viper.GetString("Apiiro.Domain"))
+			err := sendRequest(endpoint, viper.GetString("Config.Token"), "Config", *request)
+			if err == nil {
+				configSync.lock.Lock()
+				configSync.synced = request.Revision
+				configSync.syncedAt = time.Now()
+				if configSync.pending == request {
+					configSync.pending = nil
+				}
+				configSync.lock.Unlock()
+
+				log.Println("Config revision acknowledged", request.Revision)
+				attempt = 0
+				continue
+			}
+
+			delay := sendBackoff(attempt)
+			log.Printf("Error sending config revision %s, retrying in %s (attempt %d): %v\n", request.Revision, delay, attempt, err)
+			select {
+			case <-time.After(delay):
+			case <-configSync.wake:
+				// A newer manifest is sent right away.
+				attempt = 0
+			}
+		}
+	}
+}
+
+// SyncStatus returns the last revision acknowledged by the server and when, and the revision waiting to be sent.
+func SyncStatus() (string, time.Time, string) {
+	configSync.lock.Lock()
+	defer configSync.lock.Unlock()
+
+	pending := ""
+	if configSync.pending != nil {
+		pending = configSync.pending.Revision
+	}
+	return configSync.synced, configSync.syncedAt, pending
+}
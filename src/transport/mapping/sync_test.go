@@ -0,0 +1,63 @@
+package mapping
+
+import (
+	"regexp"
+	"testing"
+)
+
+func TestManifestRevision(t *testing.T) {
+	manifest := func(edit func(*NetworkBrokerConfigurationRequest)) NetworkBrokerConfigurationRequest {
+		request := NetworkBrokerConfigurationRequest{
+			ManifestVersion: ManifestVersion,
+			Hosts: []HostConfigurationRequest{
+				{MappedOrder: 1, Host: "a.corp", MappedAddress: "10.1.0.1", Ports: []PortRequest{{Port: 443, Protocol: "tcp"}}, Labels: map[string]string{"team": "dev", "env": "prod"}},
+				{MappedOrder: 2, Host: "b.corp", MappedAddress: "10.1.0.2", Resolution: "failed", ResolutionError: "no such host"},
+			},
+			MappedPrefix: "10.1.0.0/24",
+		}
+		if edit != nil {
+			edit(&request)
+		}
+		return request
+	}
+	base := manifestRevision(manifest(nil))
+
+	if !regexp.MustCompile(`^[0-9a-f]{32}$`).MatchString(base) {
+		t.Fatalf("manifestRevision() = %q, want 32 hex digits", base)
+	}
+
+	tests := []struct {
+		name     string
+		edit     func(*NetworkBrokerConfigurationRequest)
+		wantSame bool
+	}{
+		{name: "same manifest", wantSame: true},
+		{name: "revision set", edit: func(r *NetworkBrokerConfigurationRequest) { r.Revision = "old" }, wantSame: true},
+		{name: "other lookup error", edit: func(r *NetworkBrokerConfigurationRequest) { r.Hosts[1].ResolutionError = "i/o timeout" }, wantSame: true},
+		{name: "labels in another order", edit: func(r *NetworkBrokerConfigurationRequest) {
+			r.Hosts[0].Labels = map[string]string{"env": "prod", "team": "dev"}
+		}, wantSame: true},
+		{name: "resolution changed", edit: func(r *NetworkBrokerConfigurationRequest) { r.Hosts[1].Resolution = "resolved" }},
+		{name: "address changed", edit: func(r *NetworkBrokerConfigurationRequest) { r.Hosts[0].MappedAddress = "10.1.0.3" }},
+		{name: "port changed", edit: func(r *NetworkBrokerConfigurationRequest) { r.Hosts[0].Ports[0].Port = 8443 }},
+		{name: "host removed", edit: func(r *NetworkBrokerConfigurationRequest) { r.Hosts = r.Hosts[:1] }},
+		{name: "prefix changed", edit: func(r *NetworkBrokerConfigurationRequest) { r.MappedPrefix = "10.2.0.0/24" }},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			request := manifest(test.edit)
+			revision := manifestRevision(request)
+			if (revision == base) != test.wantSame {
+				t.Errorf("manifestRevision() = %s, base %s, want same %v", revision, base, test.wantSame)
+			}
+		})
+	}
+
+	// Lookup errors are left out of the hash, not out of the manifest.
+	request := manifest(nil)
+	manifestRevision(request)
+	if request.Hosts[1].ResolutionError != "no such host" {
+		t.Errorf("manifestRevision() cleared the lookup error of the manifest it was given")
+	}
+}
@@ -0,0 +1,96 @@
+package mapping
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"wiretap/transport"
+)
+
+// tlsHandshakeTimeout bounds the handshakes of TLS origination.
+const tlsHandshakeTimeout = 10 * time.Second
+
+// TLSOrigination makes the agent accept plaintext on the TCP ports of a mapping and connect to the
+// backend over TLS.
+type TLSOrigination struct {
+	// CA is a PEM bundle the backend certificate is verified against. The system roots are used when empty.
+	CA string
+	// Cert and Key are a PEM client certificate and its key, presented to backends that ask for one.
+	Cert string
+	Key  string
+	// ServerName is sent as SNI and verified against the backend certificate. It defaults to the host.
+	ServerName string
+}
+
+// config reads the CA bundle and client certificate into a client configuration for host.
+// Files are read on every setup, so that rotated certificates are picked up.
+func (o TLSOrigination) config(host string) (*tls.Config, error) {
+	config := &tls.Config{ServerName: o.ServerName}
+	if config.ServerName == "" {
+		config.ServerName = host
+	}
+
+	if o.CA != "" {
+		data, err := os.ReadFile(o.CA)
+		if err != nil {
+			return nil, fmt.Errorf("CA bundle: %w", err)
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("CA bundle %s has no PEM certificates", o.CA)
+		}
+	}
+
+	if o.Cert != "" || o.Key != "" {
+		if o.Cert == "" || o.Key == "" {
+			return nil, fmt.Errorf("client certificate needs both a cert and a key")
+		}
+		cert, err := tls.LoadX509KeyPair(o.Cert, o.Key)
+		if err != nil {
+			return nil, fmt.Errorf("client certificate: %w", err)
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+
+	return config, nil
+}
+
+// tlsOriginationHandler serves plaintext connections to a port of a target by connecting to its backend over TLS.
+func tlsOriginationHandler(mapping HostMapping, t target, port Port) (proxyHandler, error) {
+	config, err := mapping.TLS.config(mapping.Host)
+	if err != nil {
+		return nil, err
+	}
+
+	return func(conn *proxyConn) {
+		address, ok := t.backendAddress(port)
+		if !ok {
+			conn.Close()
+			return
+		}
+
+		dst, err := dialBackend(address)
+		if err != nil {
+			log.Printf("Unable to connect to %s of %s: %v\n", address, mapping.Host, err)
+			conn.reset()
+			return
+		}
+
+		tlsConn := tls.Client(dst, config)
+		tlsConn.SetDeadline(time.Now().Add(tlsHandshakeTimeout))
+		err = tlsConn.Handshake()
+		if err != nil {
+			log.Printf("TLS handshake with %s of %s failed: %v\n", address, mapping.Host, err)
+			dst.Close()
+			conn.Close()
+			return
+		}
+		tlsConn.SetDeadline(time.Time{})
+
+		transport.Proxy(conn, tlsConn)
+	}, nil
+}
@@ -0,0 +1,69 @@
+package mapping
+
+import (
+	"log"
+	"path/filepath"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/spf13/viper"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+)
+
+// reloadDelay folds the burst of events of a single file update into one reload.
+const reloadDelay = 500 * time.Millisecond
+
+// WatchFile reloads the mapping whenever Mapping.File changes. The directory is watched so that files
+// replaced by a rename, as editors and Kubernetes config maps do, are followed.
+func WatchFile(s *stack.Stack) {
+	path := viper.GetString("Mapping.File")
+	if path == "" {
+		return
+	}
+
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		log.Println("Unable to watch mapping file", err)
+		return
+	}
+	defer watcher.Close()
+
+	err = watcher.Add(filepath.Dir(path))
+	if err != nil {
+		log.Println("Unable to watch mapping file", err)
+		return
+	}
+
+	path = filepath.Clean(path)
+	var reload <-chan time.Time
+	for {
+		select {
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return
+			}
+			// Config maps update files by swapping the ..data link next to them.
+			if filepath.Clean(event.Name) != path && filepath.Base(event.Name) != "..data" {
+				continue
+			}
+			if event.Op == fsnotify.Chmod {
+				continue
+			}
+			reload = time.After(reloadDelay)
+
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return
+			}
+			log.Println("Error watching mapping file", err)
+
+		case <-reload:
+			reload = nil
+			log.Println("Mapping file changed, reloading", path)
+			err := Reload(s, nil)
+			if err != nil {
+				log.Println("Keeping the current mapping configuration:", err)
+			}
+		}
+	}
+}
@@ -0,0 +1,262 @@
+package mapping
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/spf13/viper"
+	"golang.org/x/sync/singleflight"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+)
+
+const (
+	// defaultIdleTimeout is how long an on-demand mapping is kept without new connections or queries.
+	defaultIdleTimeout = time.Hour
+	// defaultMaxMappings caps the on-demand mappings, so that queries for made-up names cannot take the prefix.
+	defaultMaxMappings = 256
+)
+
+var (
+	errNoWildcard      = errors.New("no wildcard entry matches")
+	errNoSuchHost      = errors.New("host does not resolve")
+	errTooManyMappings = errors.New("too many on-demand mappings")
+)
+
+// onDemandCalls lets concurrent queries for a name share a single mapping of it.
+var onDemandCalls singleflight.Group
+
+// onDemandFull is set once the on-demand mappings reach their maximum, so that it is logged once.
+// It is guarded by current.lock.
+var onDemandFull bool
+
+// activity records when an on-demand mapping was last used.
+type activity struct {
+	lastUsed atomic.Int64
+}
+
+func (a *activity) touch() {
+	a.lastUsed.Store(time.Now().UnixNano())
+}
+
+func (a *activity) idle() time.Duration {
+	return time.Since(time.Unix(0, a.lastUsed.Load()))
+}
+
+// activityMatcher records new connections to an on-demand mapping. It always matches.
+type activityMatcher struct {
+	activity *activity
+}
+
+func (am *activityMatcher) Match(hook stack.Hook, pkt stack.PacketBufferPtr, _, _ string) (bool, bool) {
+	am.activity.touch()
+	return true, false
+}
+
+// onDemand holds the wildcard entries and the mappings created for names under them.
+var onDemand struct {
+	lock      sync.Mutex
+	wildcards []HostMapping
+	mappings  []HostMapping
+}
+
+func isWildcard(host string) bool {
+	return strings.HasPrefix(host, "*.")
+}
+
+// matchWildcard returns the wildcard entry a name falls under. Names at any depth below the domain match.
+func matchWildcard(wildcards []HostMapping, name string) (HostMapping, bool) {
+	name = strings.TrimSuffix(strings.ToLower(name), ".")
+	for _, wildcard := range wildcards {
+		if strings.HasSuffix(name, strings.ToLower(wildcard.Host[1:])) {
+			return wildcard, true
+		}
+	}
+	return HostMapping{}, false
+}
+
+func splitWildcards(hostMappings []HostMapping) ([]HostMapping, []HostMapping) {
+	var mapped, wildcards []HostMapping
+	for _, mapping := range hostMappings {
+		if isWildcard(mapping.Host) {
+			wildcards = append(wildcards, mapping)
+		} else {
+			mapped = append(mapped, mapping)
+		}
+	}
+	return mapped, wildcards
+}
+
+// keptOnDemand returns the on-demand mappings that are still used and match one of the wildcard entries.
+func keptOnDemand(wildcards []HostMapping) []HostMapping {
+	onDemand.lock.Lock()
+	defer onDemand.lock.Unlock()
+
+	if len(wildcards) > 0 && !dnsAddress.IsValid() {
+		log.Println("Wildcard entries are only mapped through the DNS responder, which is disabled")
+	}
+
+	idleTimeout := viper.GetDuration("Mapping.Wildcard.IdleTimeout")
+	if idleTimeout <= 0 {
+		idleTimeout = defaultIdleTimeout
+	}
+
+	var mappings []HostMapping
+	for _, mapping := range onDemand.mappings {
+		wildcard, ok := matchWildcard(wildcards, mapping.Host)
+		if !ok || mapping.activity.idle() > idleTimeout {
+			log.Println("Dropping on-demand mapping", mapping.Host)
+			continue
+		}
+		// Follow changes to the ports of the wildcard entry
+		mapping.Ports = wildcard.Ports
+		mapping.TLS = wildcard.TLS
+		mapping.Proxy = wildcard.Proxy
+		mapping.Wildcard = wildcard.Host
+		mappings = append(mappings, mapping)
+	}
+
+	return mappings
+}
+
+// setOnDemand replaces the wildcard entries and the on-demand mappings.
+func setOnDemand(wildcards []HostMapping, mappings []HostMapping) {
+	onDemand.lock.Lock()
+	defer onDemand.lock.Unlock()
+
+	onDemand.wildcards = wildcards
+	onDemand.mappings = mappings
+}
+
+func onDemandHosts() []HostMapping {
+	onDemand.lock.Lock()
+	defer onDemand.lock.Unlock()
+
+	return append([]HostMapping(nil), onDemand.mappings...)
+}
+
+func onDemandWildcards() []string {
+	onDemand.lock.Lock()
+	defer onDemand.lock.Unlock()
+
+	var wildcards []string
+	for _, wildcard := range onDemand.wildcards {
+		wildcards = append(wildcards, wildcard.Host)
+	}
+	return wildcards
+}
+
+// touchOnDemand records a query for an on-demand mapping.
+func touchOnDemand(name string) {
+	onDemand.lock.Lock()
+	defer onDemand.lock.Unlock()
+
+	name = strings.TrimSuffix(strings.ToLower(name), ".")
+	for _, mapping := range onDemand.mappings {
+		if mapping.Host == name {
+			mapping.activity.touch()
+		}
+	}
+}
+
+// mapOnDemand maps a name under a wildcard entry and returns the name table that includes it.
+// The name must resolve on the agent. Concurrent calls for the same name share one mapping.
+func mapOnDemand(name string) (*nameTable, error) {
+	onDemand.lock.Lock()
+	wildcard, ok := matchWildcard(onDemand.wildcards, name)
+	onDemand.lock.Unlock()
+	if !ok {
+		return nil, errNoWildcard
+	}
+
+	table, err, _ := onDemandCalls.Do(canonicalName(name), func() (any, error) {
+		return mapName(name, wildcard)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return table.(*nameTable), nil
+}
+
+// mapName maps a name under wildcard. The name is resolved before taking the lock, so that a slow lookup
+// holds up neither setups nor other names.
+func mapName(name string, wildcard HostMapping) (*nameTable, error) {
+	host := strings.TrimSuffix(strings.ToLower(name), ".")
+	if _, _, err := resolveIP(host); err != nil {
+		return nil, errNoSuchHost
+	}
+
+	current.lock.Lock()
+	defer current.lock.Unlock()
+
+	if current.s == nil {
+		return nil, errors.New("mapping is not set up yet")
+	}
+
+	// The name may have been mapped while resolving or waiting for the lock.
+	if _, found := current.names.forward[canonicalName(name)]; found {
+		return current.names, nil
+	}
+
+	maxMappings := viper.GetInt("Mapping.Wildcard.MaxMappings")
+	if maxMappings <= 0 {
+		maxMappings = defaultMaxMappings
+	}
+	if len(onDemandHosts()) >= maxMappings {
+		if !onDemandFull {
+			log.Printf("On-demand mappings reached the maximum of %d, names under wildcard entries are not mapped until some expire\n", maxMappings)
+			onDemandFull = true
+		}
+		return nil, fmt.Errorf("%w, at most %d are kept", errTooManyMappings, maxMappings)
+	}
+	onDemandFull = false
+
+	mapping := HostMapping{
+		Host:     host,
+		Ports:    wildcard.Ports,
+		Name:     wildcard.Name,
+		Kind:     wildcard.Kind,
+		TLS:      wildcard.TLS,
+		Proxy:    wildcard.Proxy,
+		Labels:   wildcard.Labels,
+		Wildcard: wildcard.Host,
+		activity: &activity{},
+	}
+	mapping.activity.touch()
+
+	// Assign again, the allocator keeps existing hosts at their orders.
+	hosts := append(append(make([]HostMapping, 0, len(current.hosts)+1), current.hosts...), mapping)
+
+	err := allocations.assign(hosts, current.prefix, current.prefix6)
+	if err != nil {
+		return nil, err
+	}
+	mapping = hosts[len(hosts)-1]
+
+	names := current.names.clone()
+	targets4, targets6 := mappingTargets(mapping, current.prefix, current.prefix6, names)
+	if len(targets4) == 0 && len(targets6) == 0 {
+		return nil, fmt.Errorf("unable to map %s", host)
+	}
+
+	current.hosts = hosts
+	current.targets4 = append(current.targets4, targets4...)
+	current.targets6 = append(current.targets6, targets6...)
+	current.names = names
+	current.apply()
+
+	onDemand.lock.Lock()
+	onDemand.mappings = append(onDemand.mappings, mapping)
+	onDemand.lock.Unlock()
+
+	log.Printf("On-demand host: %s, Ports: %v, Order: %d\n", mapping.Host, mapping.Ports, mapping.Order)
+
+	if current.sendToServer {
+		SendConfig(hosts, current.prefix, current.prefix6)
+	}
+	return names, nil
+}
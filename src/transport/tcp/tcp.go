@@ -11,11 +11,11 @@ import (
 	"fmt"
 	"log"
 	"net"
-	"os"
 	"sync"
 	"syscall"
 	"time"
 	"wiretap/transport"
+	"wiretap/transport/upstream"
 
 	"net/netip"
 
@@ -82,20 +82,16 @@ func Handler(c Config) func(*tcp.ForwarderRequest) {
 	}
 }
 
-// checkDst determines if a tcp connection can be made to a destination.
+// checkDst determines if a tcp connection can be made to a destination, through the upstream proxy if any.
 // Returns the connection on success,
 // a channel for the caller to populate when the connection is used,
 // and whether or not to send RST to source.
 func checkDst(config *Config, s stack.TransportEndpointID) (net.Conn, chan bool, bool) {
-	c, err := net.DialTimeout("tcp", net.JoinHostPort(s.LocalAddress.String(), fmt.Sprint(s.LocalPort)), config.ConnTimeout)
+	c, err := upstream.DialTimeout(net.JoinHostPort(s.LocalAddress.String(), fmt.Sprint(s.LocalPort)), config.ConnTimeout)
 	if err != nil {
-		// If connection refused, we can send a reset to let peer know.
-		if oerr, ok := err.(*net.OpError); ok {
-			if syserr, ok := oerr.Err.(*os.SyscallError); ok {
-				if syserr.Err == syscall.ECONNREFUSED {
-					return nil, nil, true
-				}
-			}
+		// If connection refused, by the destination or the upstream proxy, we can send a reset to let peer know.
+		if errors.Is(err, syscall.ECONNREFUSED) {
+			return nil, nil, true
 		}
 
 		// Different error, don't send reset.
@@ -79,6 +79,14 @@ func (c *ConnCounts) AddAddress(addr netip.Addr, s *stack.Stack, stackLock *sync
 	return nil
 }
 
+// Count returns the number of connections to an address.
+func (c *ConnCounts) Count(addr netip.Addr) int {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return c.counts[addr]
+}
+
 // GetNetworkLayer parses a network header, then converts it to bytes.
 func GetNetworkLayer[H IPHeader, L IPLayer](netHeader header.Network, ipLayer L) (L, error) {
 	h, ok := netHeader.(H)
@@ -174,8 +182,7 @@ func ForwardTcpPort(s *stack.Stack, l net.Listener, localAddr tcpip.FullAddress,
 
 		// Proxy between conns.
 		go func() {
-			var nc net.Conn
-			nc, err = gonet.DialTCPWithBind(
+			nc, err := gonet.DialTCPWithBind(
 				ctx,
 				s,
 				localAddr,
@@ -30,9 +30,19 @@ import (
 )
 
 // udpConn holds socket addresses for source and destination.
+// Mapped is the original destination of a DNATed flow, and is invalid otherwise.
 type udpConn struct {
 	Source netip.AddrPort
 	Dest   netip.AddrPort
+	Mapped netip.AddrPort
+}
+
+// replyAddr returns the address the peer expects responses to come from.
+func (c udpConn) replyAddr() netip.AddrPort {
+	if c.Mapped.IsValid() {
+		return c.Mapped
+	}
+	return c.Dest
 }
 
 type dialerCount struct {
@@ -59,9 +69,17 @@ func Handler(c Config) func(stack.TransportEndpointID, stack.PacketBufferPtr) bo
 	return func(teid stack.TransportEndpointID, pkb stack.PacketBufferPtr) bool {
 		log.Printf("(client %s) - Transport: UDP -> %s", net.JoinHostPort(teid.RemoteAddress.String(), fmt.Sprint(teid.RemotePort)), net.JoinHostPort(teid.LocalAddress.String(), fmt.Sprint(teid.LocalPort)))
 
+		// Packets to a mapped address were DNATed in prerouting, responses must come from the original destination.
+		var mapped netip.AddrPort
+		origAddr, origPort, tcpipErr := c.Tnet.Stack().IPTables().OriginalDst(teid, pkb.NetworkProtocolNumber, header.UDPProtocolNumber)
+		if tcpipErr == nil {
+			addr, _ := netip.AddrFromSlice(origAddr.AsSlice())
+			mapped = netip.AddrPortFrom(addr, origPort)
+		}
+
 		packetClone := pkb.Clone()
 		go func() {
-			newPacket(packetClone, c.Tnet.Stack())
+			newPacket(packetClone, mapped, c.Tnet.Stack())
 			packetClone.DecRef()
 		}()
 
@@ -130,7 +148,7 @@ func getDataFromPacket(packet stack.PacketBufferPtr) []byte {
 }
 
 // NewPacket handles every new packet and sending it to the proper UDP dialer.
-func newPacket(packet stack.PacketBufferPtr, s *stack.Stack) {
+func newPacket(packet stack.PacketBufferPtr, mapped netip.AddrPort, s *stack.Stack) {
 	netHeader := packet.Network()
 	transHeader := header.UDP(netHeader.Payload())
 
@@ -140,7 +158,7 @@ func newPacket(packet stack.PacketBufferPtr, s *stack.Stack) {
 	var pktChan chan stack.PacketBufferPtr
 	var ok bool
 
-	conn := udpConn{Source: source, Dest: dest}
+	conn := udpConn{Source: source, Dest: dest, Mapped: mapped}
 	pktChan, ok = connMapLookup(conn)
 	if ok {
 		// Dialer already exists, just forward packet.
@@ -246,7 +264,7 @@ func handleConn(conn udpConn, port int, s *stack.Stack) {
 			if oerr, ok := err.(*net.OpError); ok {
 				if syserr, ok := oerr.Err.(*os.SyscallError); ok {
 					if syserr.Err == syscall.ECONNREFUSED {
-						go sendUnreachable(mostRecentPacket, s)
+						go sendUnreachable(conn, mostRecentPacket, s)
 					}
 				}
 			}
@@ -278,16 +296,17 @@ func sendResponse(conn udpConn, data []byte, s *stack.Stack) {
 	var ipv4Layer *layers.IPv4
 	var ipv6Layer *layers.IPv6
 
+	replyAddr := conn.replyAddr()
 	udpLayer := &layers.UDP{
-		SrcPort: layers.UDPPort(conn.Dest.Port()),
+		SrcPort: layers.UDPPort(replyAddr.Port()),
 		DstPort: layers.UDPPort(conn.Source.Port()),
 	}
 
-	isIpv6 := conn.Dest.Addr().Is6()
+	isIpv6 := replyAddr.Addr().Is6()
 	if isIpv6 {
 		ipv6Layer = &layers.IPv6{
 			Version:    6,
-			SrcIP:      conn.Dest.Addr().AsSlice(),
+			SrcIP:      replyAddr.Addr().AsSlice(),
 			DstIP:      conn.Source.Addr().AsSlice(),
 			NextHeader: layers.IPProtocolUDP,
 			HopLimit:   64,
@@ -297,7 +316,7 @@ func sendResponse(conn udpConn, data []byte, s *stack.Stack) {
 		ipv4Layer = &layers.IPv4{
 			Version: 4,
 			//IHL: 5,
-			SrcIP:    conn.Dest.Addr().AsSlice(),
+			SrcIP:    replyAddr.Addr().AsSlice(),
 			DstIP:    conn.Source.Addr().AsSlice(),
 			Protocol: layers.IPProtocolUDP,
 			TTL:      64,
@@ -345,7 +364,7 @@ func sendResponse(conn udpConn, data []byte, s *stack.Stack) {
 
 // sendUnreachable sends an ICMP Port Unreachable packet to peer as if from
 // the original destination of the packet.
-func sendUnreachable(packet stack.PacketBufferPtr, s *stack.Stack) {
+func sendUnreachable(conn udpConn, packet stack.PacketBufferPtr, s *stack.Stack) {
 	var err error
 	var ipv4Layer *layers.IPv4
 	var ipv6Layer *layers.IPv6
@@ -357,6 +376,18 @@ func sendUnreachable(packet stack.PacketBufferPtr, s *stack.Stack) {
 	transHeader.SetChecksum(0)
 	transHeaderPayload := transHeader.Payload()
 
+	// Undo DNAT so the quoted datagram matches what the peer sent.
+	if conn.Mapped.IsValid() {
+		mappedAddr := tcpip.AddrFromSlice(conn.Mapped.Addr().AsSlice())
+		switch h := netHeader.(type) {
+		case header.IPv4:
+			h.SetDestinationAddressWithChecksumUpdate(mappedAddr)
+		case header.IPv6:
+			h.SetDestinationAddress(mappedAddr)
+		}
+		transHeader.SetDestinationPort(conn.Mapped.Port())
+	}
+
 	isIpv6 := netHeader.DestinationAddress().To4() == tcpip.Address{}
 
 	if isIpv6 {
@@ -0,0 +1,287 @@
+package upstream
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+	"golang.org/x/sync/singleflight"
+)
+
+const (
+	// bastionHandshakeTimeout bounds connecting and authenticating to a bastion.
+	bastionHandshakeTimeout = 15 * time.Second
+	// bastionKeepalive is how often bastion connections are checked, broken ones are reconnected on the next dial.
+	bastionKeepalive = 30 * time.Second
+)
+
+// bastion is a persistent SSH connection to a jump host. Connections to destinations behind it are
+// direct-tcpip channels of the connection, which is reconnected when it breaks.
+type bastion struct {
+	name string
+	url  *url.URL
+
+	lock   sync.Mutex
+	client *ssh.Client
+	// closed is set when the bastion is no longer used, a connection established afterwards is dropped.
+	closed bool
+	// connecting shares a connection attempt between the dials waiting for it.
+	connecting singleflight.Group
+}
+
+// bastions are the bastions by URL, connections are shared by every destination behind a bastion.
+var bastions = struct {
+	lock  sync.Mutex
+	byURL map[string]*bastion
+}{byURL: make(map[string]*bastion)}
+
+func bastionFor(u *url.URL) *bastion {
+	bastions.lock.Lock()
+	defer bastions.lock.Unlock()
+
+	b, ok := bastions.byURL[u.String()]
+	if !ok {
+		b = &bastion{name: fmt.Sprintf("%s@%s", u.User.Username(), u.Host), url: u}
+		bastions.byURL[u.String()] = b
+	}
+	return b
+}
+
+// retainBastions disconnects the bastions that are no longer used by the configuration or a destination.
+// The caller holds config.lock.
+func retainBastions() {
+	used := make(map[string]bool)
+	use := func(u *url.URL) {
+		if u != nil && u.Scheme == "ssh" {
+			used[u.String()] = true
+		}
+	}
+	use(config.proxy)
+	for _, r := range config.routes {
+		use(r.proxy)
+	}
+	for _, destination := range config.destinations {
+		if u, err := ParseProxy(destination.Proxy); err == nil {
+			use(u)
+		}
+	}
+
+	bastions.lock.Lock()
+	defer bastions.lock.Unlock()
+
+	for key, b := range bastions.byURL {
+		if used[key] {
+			continue
+		}
+		b.lock.Lock()
+		if b.client != nil {
+			b.client.Close()
+			b.client = nil
+		}
+		b.closed = true
+		b.lock.Unlock()
+		delete(bastions.byURL, key)
+	}
+}
+
+// validateBastion checks the parts of an ssh:// proxy URL. Files are read when connecting, so that rotated
+// keys are picked up when the connection is reestablished.
+func validateBastion(u *url.URL) error {
+	if u.User.Username() == "" {
+		return fmt.Errorf("invalid bastion '%s', missing user", u.Redacted())
+	}
+	_, hasPassword := u.User.Password()
+	if u.Query().Get("key") == "" && !hasPassword {
+		return fmt.Errorf("invalid bastion '%s', missing key or password", u.Redacted())
+	}
+	for name := range u.Query() {
+		if name != "key" && name != "known_hosts" {
+			return fmt.Errorf("invalid bastion '%s', unknown option '%s'", u.Redacted(), name)
+		}
+	}
+	return nil
+}
+
+// clientConfig reads the key and known hosts of the bastion. known_hosts defaults to that of the user running the agent.
+func (b *bastion) clientConfig() (*ssh.ClientConfig, error) {
+	query := b.url.Query()
+
+	var auth []ssh.AuthMethod
+	if keyFile := query.Get("key"); keyFile != "" {
+		data, err := os.ReadFile(keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("bastion key: %w", err)
+		}
+		signer, err := ssh.ParsePrivateKey(data)
+		if err != nil {
+			return nil, fmt.Errorf("bastion key %s: %w", keyFile, err)
+		}
+		auth = append(auth, ssh.PublicKeys(signer))
+	}
+	if password, ok := b.url.User.Password(); ok {
+		auth = append(auth, ssh.Password(password))
+	}
+
+	knownHostsFile := query.Get("known_hosts")
+	if knownHostsFile == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return nil, fmt.Errorf("bastion known_hosts: %w", err)
+		}
+		knownHostsFile = filepath.Join(home, ".ssh", "known_hosts")
+	}
+	hostKeyCallback, err := knownhosts.New(knownHostsFile)
+	if err != nil {
+		return nil, fmt.Errorf("bastion known_hosts: %w", err)
+	}
+
+	return &ssh.ClientConfig{
+		User:            b.url.User.Username(),
+		Auth:            auth,
+		HostKeyCallback: hostKeyCallback,
+	}, nil
+}
+
+// connect returns the SSH connection of the bastion, connecting when there is none. Dials waiting for the
+// connection share a single attempt, and give up on it when ctx is done.
+func (b *bastion) connect(ctx context.Context) (*ssh.Client, error) {
+	b.lock.Lock()
+	client := b.client
+	b.lock.Unlock()
+	if client != nil {
+		return client, nil
+	}
+
+	attempt := b.connecting.DoChan("", func() (any, error) {
+		return b.handshake()
+	})
+	select {
+	case result := <-attempt:
+		if result.Err != nil {
+			return nil, result.Err
+		}
+		return result.Val.(*ssh.Client), nil
+	case <-ctx.Done():
+		return nil, fmt.Errorf("bastion %s: %w", b.name, ctx.Err())
+	}
+}
+
+// handshake connects and authenticates to the bastion within bastionHandshakeTimeout. The lock is not held
+// meanwhile, so that dials through the current connection and disconnects are not held up.
+func (b *bastion) handshake() (*ssh.Client, error) {
+	b.lock.Lock()
+	client := b.client
+	b.lock.Unlock()
+	if client != nil {
+		return client, nil
+	}
+
+	config, err := b.clientConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), bastionHandshakeTimeout)
+	defer cancel()
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", b.url.Host)
+	if err != nil {
+		return nil, fmt.Errorf("bastion %s: %w", b.name, err)
+	}
+	deadline, _ := ctx.Deadline()
+	conn.SetDeadline(deadline)
+	clientConn, channels, requests, err := ssh.NewClientConn(conn, b.url.Host, config)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("bastion %s: %w", b.name, err)
+	}
+	conn.SetDeadline(time.Time{})
+	client = ssh.NewClient(clientConn, channels, requests)
+
+	b.lock.Lock()
+	if b.closed {
+		b.lock.Unlock()
+		client.Close()
+		return nil, fmt.Errorf("bastion %s is no longer used", b.name)
+	}
+	b.client = client
+	b.lock.Unlock()
+	log.Printf("Connected to bastion %s\n", b.name)
+
+	go b.keepalive(client)
+	go func() {
+		err := client.Wait()
+		b.lock.Lock()
+		if b.client == client {
+			b.client = nil
+		}
+		b.lock.Unlock()
+		log.Printf("Disconnected from bastion %s: %v\n", b.name, err)
+	}()
+	return client, nil
+}
+
+// keepalive closes the connection of the bastion when it stops answering, so that it is reconnected.
+func (b *bastion) keepalive(client *ssh.Client) {
+	for {
+		time.Sleep(bastionKeepalive)
+
+		answered := make(chan error, 1)
+		go func() {
+			_, _, err := client.SendRequest("keepalive@openssh.com", true, nil)
+			answered <- err
+		}()
+
+		var err error
+		select {
+		case err = <-answered:
+		case <-time.After(bastionHandshakeTimeout):
+			err = errors.New("keepalive timed out")
+		}
+		if err != nil {
+			client.Close()
+			return
+		}
+	}
+}
+
+// dial opens a channel to address through the bastion. A broken connection is reconnected once.
+func (b *bastion) dial(ctx context.Context, address string) (net.Conn, error) {
+	for attempt := 0; ; attempt++ {
+		client, err := b.connect(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		conn, err := client.DialContext(ctx, "tcp", address)
+		if err == nil {
+			return conn, nil
+		}
+
+		var channelErr *ssh.OpenChannelError
+		if errors.As(err, &channelErr) {
+			// The bastion could not connect to the destination.
+			return nil, fmt.Errorf("%w: bastion %s: %v", ErrRefused, b.name, channelErr)
+		}
+		if ctx.Err() != nil || attempt > 0 {
+			return nil, fmt.Errorf("bastion %s: %w", b.name, err)
+		}
+
+		// The connection is broken, drop it and connect again.
+		b.lock.Lock()
+		if b.client == client {
+			b.client = nil
+		}
+		b.lock.Unlock()
+		client.Close()
+	}
+}
@@ -0,0 +1,173 @@
+package upstream
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/netip"
+	"net/url"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestBypassed(t *testing.T) {
+	tests := []struct {
+		name    string
+		noProxy string
+		host    string
+		ip      string
+		want    bool
+	}{
+		{name: "empty list", noProxy: "", host: "a.corp", ip: "10.0.0.1", want: false},
+		{name: "everything", noProxy: "*", host: "a.corp", want: true},
+		{name: "domain", noProxy: "corp", host: "a.corp", want: true},
+		{name: "domain itself", noProxy: "a.corp", host: "a.corp", want: true},
+		{name: "subdomain", noProxy: "a.corp", host: "x.a.corp", want: true},
+		{name: "leading dot", noProxy: ".corp", host: "a.corp", want: true},
+		{name: "leading wildcard", noProxy: "*.corp", host: "a.corp", want: true},
+		{name: "suffix of another name", noProxy: "corp", host: "a.notcorp", want: false},
+		{name: "case and trailing dot", noProxy: "A.Corp.", host: "x.a.CORP.", want: true},
+		{name: "address", noProxy: "10.0.0.1", host: "a.corp", ip: "10.0.0.1", want: true},
+		{name: "other address", noProxy: "10.0.0.1", host: "a.corp", ip: "10.0.0.2", want: false},
+		{name: "subnet", noProxy: "10.0.0.0/8", host: "a.corp", ip: "10.20.0.1", want: true},
+		{name: "subnet without address", noProxy: "10.0.0.0/8", host: "a.corp", want: false},
+		{name: "mapped ipv4 address", noProxy: "10.0.0.0/8", ip: "::ffff:10.20.0.1", want: true},
+		{name: "bracketed ipv6 address", noProxy: "[fd::1]", ip: "fd::1", want: true},
+		{name: "ipv6 subnet", noProxy: "fd::/64", ip: "fd::5", want: true},
+		{name: "list with spaces and commas", noProxy: "localhost, 127.0.0.1 .corp", host: "a.corp", want: true},
+		{name: "no match in list", noProxy: "localhost,127.0.0.1,.corp", host: "example.com", ip: "93.184.216.34", want: false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			rules, err := parseBypass(test.noProxy)
+			if err != nil {
+				t.Fatalf("parseBypass(%q) error = %v", test.noProxy, err)
+			}
+			var ip netip.Addr
+			if test.ip != "" {
+				ip = netip.MustParseAddr(test.ip)
+			}
+			if got := bypassed(rules, test.host, ip); got != test.want {
+				t.Errorf("bypassed(%q, %q, %s) = %v, want %v", test.noProxy, test.host, ip, got, test.want)
+			}
+		})
+	}
+}
+
+func TestParseBypassErrors(t *testing.T) {
+	for _, noProxy := range []string{"10.0.0.0/33", "a/b", ".", "*.", "a.*.corp"} {
+		t.Run(noProxy, func(t *testing.T) {
+			if _, err := parseBypass(noProxy); err == nil {
+				t.Errorf("parseBypass(%q) succeeded, want an error", noProxy)
+			}
+		})
+	}
+}
+
+func TestProxyFor(t *testing.T) {
+	err := Configure("http://proxy.corp:3128", ".internal,10.9.0.0/16", "10.20.0.0/16=socks5://socks.corp:1080,10.20.5.0/24=direct")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { Configure("", "", "") })
+
+	tests := []struct {
+		name        string
+		destination Destination
+		ip          string
+		want        string
+	}{
+		{name: "upstream proxy", destination: Destination{Host: "a.corp"}, ip: "10.1.0.1", want: "http://proxy.corp:3128"},
+		{name: "bypassed domain", destination: Destination{Host: "a.internal"}, ip: "10.1.0.1", want: Direct},
+		{name: "bypassed subnet", destination: Destination{Host: "a.corp"}, ip: "10.9.0.1", want: Direct},
+		{name: "route", destination: Destination{Host: "a.corp"}, ip: "10.20.0.1", want: "socks5://socks.corp:1080"},
+		{name: "more specific route", destination: Destination{Host: "a.corp"}, ip: "10.20.5.1", want: Direct},
+		{name: "route before bypass", destination: Destination{Host: "a.internal"}, ip: "10.20.0.1", want: "socks5://socks.corp:1080"},
+		{name: "own proxy", destination: Destination{Host: "a.internal", Proxy: "socks5h://own.corp:1080"}, ip: "10.20.0.1", want: "socks5h://own.corp:1080"},
+		{name: "own direct", destination: Destination{Host: "a.corp", Proxy: Direct}, ip: "10.1.0.1", want: Direct},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			u, err := proxyFor(test.destination, netip.MustParseAddr(test.ip))
+			if err != nil {
+				t.Fatalf("proxyFor() error = %v", err)
+			}
+			got := Direct
+			if u != nil {
+				got = u.String()
+			}
+			if got != test.want {
+				t.Errorf("proxyFor(%+v, %s) = %s, want %s", test.destination, test.ip, got, test.want)
+			}
+		})
+	}
+}
+
+func TestDialSOCKS(t *testing.T) {
+	tests := []struct {
+		name        string
+		user        *url.Userinfo
+		reply       byte
+		wantErr     bool
+		wantRefused bool
+	}{
+		{name: "connected", reply: 0},
+		{name: "connected with a password", user: url.UserPassword("u", "p"), reply: 0},
+		{name: "destination refused", reply: 5, wantErr: true, wantRefused: true},
+		{name: "not allowed", reply: 2, wantErr: true, wantRefused: true},
+		{name: "host unreachable", reply: 4, wantErr: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			listener, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer listener.Close()
+
+			// The proxy checks the greeting and the credentials, reads the request and answers test.reply.
+			go func() {
+				conn, err := listener.Accept()
+				if err != nil {
+					return
+				}
+				defer conn.Close()
+
+				greeting := make([]byte, 3)
+				io.ReadFull(conn, greeting)
+				conn.Write([]byte{5, greeting[2]})
+				if greeting[2] == 2 {
+					credentials := make([]byte, 5)
+					io.ReadFull(conn, credentials)
+					status := byte(1)
+					if string(credentials) == "\x01\x01u\x01p" {
+						status = 0
+					}
+					conn.Write([]byte{1, status})
+				}
+				request := make([]byte, 10)
+				io.ReadFull(conn, request)
+				conn.Write([]byte{5, test.reply, 0, 1, 10, 0, 0, 1, 0, 80})
+			}()
+
+			u := &url.URL{Scheme: "socks5", Host: listener.Addr().String(), User: test.user}
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			conn, err := dialSOCKS(ctx, u, "10.0.0.1:80")
+			if err == nil {
+				conn.Close()
+			}
+			if (err != nil) != test.wantErr {
+				t.Fatalf("dialSOCKS() error = %v, want error %v", err, test.wantErr)
+			}
+			if refused := errors.Is(err, syscall.ECONNREFUSED); refused != test.wantRefused {
+				t.Errorf("dialSOCKS() error = %v, refused %v, want %v", err, refused, test.wantRefused)
+			}
+		})
+	}
+}
@@ -0,0 +1,188 @@
+package webhook
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"time"
+
+	"github.com/spf13/viper"
+	"golang.zx2c4.com/wireguard/tun/netstack"
+)
+
+const (
+	deliveryTimeout = 30 * time.Second
+
+	firstDeliveryBackoff = time.Second
+	maxDeliveryBackoff   = 5 * time.Minute
+)
+
+var (
+	// errRejected is returned for webhooks the platform will never accept, they are set aside rather than retried.
+	errRejected = errors.New("rejected")
+	// errUnauthorized is returned when the platform refuses the token of the agent. Every webhook fails the same
+	// way until the token is fixed, so the source is blocked rather than its webhooks set aside.
+	errUnauthorized = errors.New("agent token refused")
+)
+
+// Statuses of webhooks that fail the same way when retried. Other errors are retried.
+var rejectedStatuses = map[int]bool{
+	http.StatusBadRequest:            true,
+	http.StatusGone:                  true,
+	http.StatusRequestEntityTooLarge: true,
+	http.StatusUnsupportedMediaType:  true,
+	http.StatusUnprocessableEntity:   true,
+}
+
+// deliverer posts webhooks to the platform.
+type deliverer struct {
+	url *url.URL
+	// tunnel is set when webhooks are posted through the tunnel, rather than from the agent's network.
+	tunnel bool
+	client *http.Client
+}
+
+// newDeliverer delivers to target through the tunnel, target must be an address in the tunnel since there is
+// no DNS there. Without a target, webhooks are posted to the platform over HTTPS.
+func newDeliverer(tnet *netstack.Net, target string) (*deliverer, error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: viper.GetBool("Skip.Ssl.Verify")}
+
+	tunnel := target != ""
+	if tunnel {
+		transport.Proxy = nil
+		transport.DialContext = tnet.DialContext
+	} else {
+		target = fmt.Sprintf("https://%s/rest-api/v1.0/broker/webhooks", viper.GetString("Apiiro.Domain"))
+	}
+
+	u, err := url.Parse(target)
+	if err != nil {
+		return nil, fmt.Errorf("invalid webhook URL: %w", err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("invalid webhook URL '%s', expected http or https", u.Redacted())
+	}
+	if tunnel {
+		if _, err := netip.ParseAddr(u.Hostname()); err != nil {
+			return nil, fmt.Errorf("invalid webhook URL '%s', the host must be a tunnel address", u.Redacted())
+		}
+	}
+
+	return &deliverer{url: u, tunnel: tunnel, client: &http.Client{Transport: transport, Timeout: deliveryTimeout}}, nil
+}
+
+// send posts a webhook with its original headers and body.
+func (d *deliverer) send(webhook Webhook) error {
+	request, err := http.NewRequest(http.MethodPost, d.url.String(), bytes.NewReader(webhook.Body))
+	if err != nil {
+		return err
+	}
+	request.Header = webhook.Header.Clone()
+	if request.Header == nil {
+		request.Header = make(http.Header)
+	}
+	// Queues written by earlier versions may still hold the secret of the sender.
+	for _, name := range secretHeaders {
+		request.Header.Del(name)
+	}
+	request.Header.Set("Authorization", "Bearer "+viper.GetString("Config.Token"))
+	request.Header.Set("X-Wiretap-Delivery", webhook.ID)
+	request.Header.Set("X-Wiretap-Source", webhook.Source)
+	request.Header.Set("X-Wiretap-Received-At", webhook.ReceivedAt.Format(time.RFC3339Nano))
+
+	response, err := d.client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode >= 200 && response.StatusCode <= 299 {
+		io.Copy(io.Discard, io.LimitReader(response.Body, 4096))
+		return nil
+	}
+	body, _ := io.ReadAll(io.LimitReader(response.Body, 512))
+	err = fmt.Errorf("server answered %s: %s", response.Status, bytes.TrimSpace(body))
+	if rejectedStatuses[response.StatusCode] {
+		return fmt.Errorf("%w: %v", errRejected, err)
+	}
+	if response.StatusCode == http.StatusUnauthorized || response.StatusCode == http.StatusForbidden {
+		return fmt.Errorf("%w: %v", errUnauthorized, err)
+	}
+	return err
+}
+
+// deliver sends the webhooks of the queue in order, forever. A webhook is retried with exponential backoff
+// until the platform accepts or rejects it, later webhooks of the source wait for it.
+func (q *queue) deliver(d *deliverer) {
+	attempt := 0
+	for {
+		webhook, seq, ok, err := q.peek()
+		if !ok {
+			<-q.wake
+			continue
+		}
+		if err != nil {
+			log.Printf("Setting aside unreadable webhook %d of %s: %v\n", seq, q.source, err)
+			q.setAside(seq)
+			continue
+		}
+
+		attempt++
+		err = d.send(webhook)
+		switch {
+		case err == nil:
+			if viper.GetBool("verbose") {
+				log.Printf("Delivered webhook %s of %s\n", webhook.ID, q.source)
+			}
+			attempt = 0
+			if err := q.pop(seq, false); err != nil {
+				log.Printf("Error removing delivered webhook %s of %s: %v\n", webhook.ID, q.source, err)
+			}
+		case errors.Is(err, errRejected):
+			log.Printf("Webhook %s of %s was rejected, setting it aside: %v\n", webhook.ID, q.source, err)
+			attempt = 0
+			q.failed(err)
+			q.setAside(seq)
+		case errors.Is(err, errUnauthorized):
+			if q.failed(err) {
+				log.Printf("Webhook delivery of %s is blocked until the agent token is fixed, retrying every %s: %v\n", q.source, maxDeliveryBackoff, err)
+			}
+			time.Sleep(maxDeliveryBackoff)
+		default:
+			delay := deliveryBackoff(attempt)
+			log.Printf("Error delivering webhook %s of %s, retrying in %s (attempt %d): %v\n", webhook.ID, q.source, delay, attempt, err)
+			q.failed(err)
+			time.Sleep(delay)
+		}
+	}
+}
+
+// setAside moves a webhook out of the queue. When that fails the queue is stuck, so it is retried.
+func (q *queue) setAside(seq uint64) {
+	for {
+		err := q.pop(seq, true)
+		if err == nil {
+			return
+		}
+		log.Printf("Error setting aside webhook %d of %s: %v\n", seq, q.source, err)
+		time.Sleep(maxDeliveryBackoff)
+	}
+}
+
+func deliveryBackoff(attempt int) time.Duration {
+	delay := firstDeliveryBackoff
+	for i := 1; i < attempt && delay < maxDeliveryBackoff; i++ {
+		delay *= 2
+	}
+	if delay > maxDeliveryBackoff {
+		return maxDeliveryBackoff
+	}
+	return delay
+}
@@ -0,0 +1,229 @@
+package webhook
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	webhookFileSuffix = ".json"
+	// rejectedDir keeps the webhooks of a source that the platform refused, they are not retried and are
+	// removed once the retention has passed.
+	rejectedDir = "rejected"
+)
+
+var errQueueFull = errors.New("queue is full")
+
+// Webhook is a request accepted by the relay, as queued on disk.
+type Webhook struct {
+	// ID identifies the webhook across delivery attempts, so that the platform can drop duplicates.
+	ID         string
+	Source     string
+	ReceivedAt time.Time
+	Header     http.Header
+	Body       []byte
+}
+
+// queue is the durable queue of the webhooks of a source. Each webhook is a file named by its sequence
+// number, webhooks are delivered and removed in that order.
+type queue struct {
+	source    string
+	dir       string
+	retention time.Duration
+	wake      chan struct{}
+
+	lock sync.Mutex
+	// first is the oldest webhook, next the sequence number of the next one.
+	first uint64
+	next  uint64
+
+	delivered       int
+	rejected        int
+	rejectedKept    int
+	blocked         bool
+	lastError       string
+	lastDeliveredAt time.Time
+}
+
+// openQueue opens the queue of a source in dir, picking up the webhooks left by a previous run. Rejected
+// webhooks are kept for retention, forever when it is not positive.
+func openQueue(dir string, source string, retention time.Duration) (*queue, error) {
+	q := &queue{source: source, dir: filepath.Join(dir, source), retention: retention, wake: make(chan struct{}, 1), first: 1, next: 1}
+	if err := os.MkdirAll(q.dir, 0700); err != nil {
+		return nil, err
+	}
+
+	entries, err := os.ReadDir(q.dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		name := entry.Name()
+		if strings.HasSuffix(name, ".tmp") {
+			// Never renamed, the webhook was not acknowledged.
+			os.Remove(filepath.Join(q.dir, name))
+			continue
+		}
+		seq, err := strconv.ParseUint(strings.TrimSuffix(name, webhookFileSuffix), 10, 64)
+		if err != nil || entry.IsDir() || !strings.HasSuffix(name, webhookFileSuffix) {
+			continue
+		}
+		if q.first == q.next || seq < q.first {
+			q.first = seq
+		}
+		if seq >= q.next {
+			q.next = seq + 1
+		}
+	}
+	q.expireRejected()
+	return q, nil
+}
+
+func (q *queue) path(seq uint64) string {
+	return filepath.Join(q.dir, fmt.Sprintf("%020d%s", seq, webhookFileSuffix))
+}
+
+// push stores a webhook at the end of the queue. It returns once the webhook is on disk.
+func (q *queue) push(webhook Webhook, maxQueued int) error {
+	data, err := json.Marshal(webhook)
+	if err != nil {
+		return err
+	}
+
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	if maxQueued > 0 && q.next-q.first >= uint64(maxQueued) {
+		return errQueueFull
+	}
+	if err := writeFileSync(q.path(q.next), data); err != nil {
+		return err
+	}
+	q.next++
+
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// peek returns the oldest webhook and its sequence number, ok is false when the queue is empty.
+func (q *queue) peek() (webhook Webhook, seq uint64, ok bool, err error) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	for ; q.first < q.next; q.first++ {
+		data, err := os.ReadFile(q.path(q.first))
+		if errors.Is(err, os.ErrNotExist) {
+			// Removed by hand.
+			continue
+		}
+		if err == nil {
+			err = json.Unmarshal(data, &webhook)
+		}
+		return webhook, q.first, true, err
+	}
+	return Webhook{}, 0, false, nil
+}
+
+// pop removes the oldest webhook once delivered, or moves it aside when rejected.
+func (q *queue) pop(seq uint64, rejected bool) error {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	var err error
+	if rejected {
+		q.rejected++
+		if err = os.MkdirAll(filepath.Join(q.dir, rejectedDir), 0700); err == nil {
+			err = os.Rename(q.path(seq), filepath.Join(q.dir, rejectedDir, filepath.Base(q.path(seq))))
+		}
+		q.expireRejected()
+	} else {
+		q.delivered++
+		q.lastDeliveredAt = time.Now()
+		q.lastError = ""
+		q.blocked = false
+		err = os.Remove(q.path(seq))
+	}
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	if seq == q.first {
+		q.first++
+	}
+	return nil
+}
+
+// expireRejected removes the rejected webhooks received longer than the retention ago and counts the others.
+// The caller holds q.lock, or is opening the queue.
+func (q *queue) expireRejected() {
+	entries, err := os.ReadDir(filepath.Join(q.dir, rejectedDir))
+	if err != nil {
+		q.rejectedKept = 0
+		return
+	}
+
+	kept := 0
+	for _, entry := range entries {
+		if q.retention > 0 {
+			if info, err := entry.Info(); err == nil && time.Since(info.ModTime()) > q.retention {
+				if os.Remove(filepath.Join(q.dir, rejectedDir, entry.Name())) == nil {
+					continue
+				}
+			}
+		}
+		kept++
+	}
+	q.rejectedKept = kept
+}
+
+// failed records a delivery error. It returns whether the source just became blocked by a refused agent token.
+func (q *queue) failed(err error) bool {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	q.lastError = err.Error()
+	blocked := errors.Is(err, errUnauthorized)
+	became := blocked && !q.blocked
+	q.blocked = blocked
+	return became
+}
+
+// writeFileSync writes a file so that it is complete on disk when it returns, even across a crash.
+func writeFileSync(path string, data []byte) error {
+	tmp := path + ".tmp"
+	file, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(data)
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp, path)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	// The rename is durable once the directory is synced. Not every platform can sync a directory.
+	if dir, err := os.Open(filepath.Dir(path)); err == nil {
+		dir.Sync()
+		dir.Close()
+	}
+	return nil
+}
@@ -0,0 +1,173 @@
+package webhook
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestQueue(t *testing.T) {
+	// Operations on the queue: push a body, deliver or reject the oldest webhook, reopen the queue as a
+	// restart does, leave an unacknowledged write behind, remove a webhook by hand, or age the rejected ones.
+	type op struct {
+		kind string
+		body string
+		seq  uint64
+	}
+	push := func(body string) op { return op{kind: "push", body: body} }
+	deliver := op{kind: "deliver"}
+	reject := op{kind: "reject"}
+	restart := op{kind: "restart"}
+	unacknowledged := op{kind: "unacknowledged"}
+	remove := func(seq uint64) op { return op{kind: "remove", seq: seq} }
+	age := op{kind: "age"}
+
+	tests := []struct {
+		name      string
+		maxQueued int
+		ops       []op
+		// want are the bodies left in the queue, in delivery order.
+		want         []string
+		wantFull     int
+		wantRejected int
+	}{
+		{
+			name: "in order",
+			ops:  []op{push("a"), push("b"), push("c")},
+			want: []string{"a", "b", "c"},
+		},
+		{
+			name: "restart keeps the order",
+			ops:  []op{push("a"), push("b"), restart, push("c")},
+			want: []string{"a", "b", "c"},
+		},
+		{
+			name: "delivered before a restart",
+			ops:  []op{push("a"), push("b"), push("c"), deliver, restart, push("d")},
+			want: []string{"b", "c", "d"},
+		},
+		{
+			name: "emptied before a restart",
+			ops:  []op{push("a"), deliver, restart, push("b")},
+			want: []string{"b"},
+		},
+		{
+			name:         "rejected",
+			ops:          []op{push("a"), push("b"), reject, restart},
+			want:         []string{"b"},
+			wantRejected: 1,
+		},
+		{
+			name:         "rejected expire",
+			ops:          []op{push("a"), push("b"), reject, age, restart},
+			want:         []string{"b"},
+			wantRejected: 0,
+		},
+		{
+			name: "unacknowledged write",
+			ops:  []op{push("a"), unacknowledged, restart, push("b")},
+			want: []string{"a", "b"},
+		},
+		{
+			name: "removed by hand",
+			ops:  []op{push("a"), push("b"), push("c"), remove(2)},
+			want: []string{"a", "c"},
+		},
+		{
+			name: "removed by hand before a restart",
+			ops:  []op{push("a"), push("b"), push("c"), remove(1), restart},
+			want: []string{"b", "c"},
+		},
+		{
+			name:      "full",
+			maxQueued: 2,
+			ops:       []op{push("a"), push("b"), push("c"), deliver, push("d")},
+			want:      []string{"b", "d"},
+			wantFull:  1,
+		},
+	}
+
+	retention := 7 * 24 * time.Hour
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir := t.TempDir()
+			q, err := openQueue(dir, "gitlab", retention)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			full := 0
+			for i, op := range test.ops {
+				switch op.kind {
+				case "push":
+					err = q.push(Webhook{Source: "gitlab", Body: []byte(op.body)}, test.maxQueued)
+					if errors.Is(err, errQueueFull) {
+						full++
+						err = nil
+					}
+				case "deliver", "reject":
+					_, seq, ok, peekErr := q.peek()
+					if !ok || peekErr != nil {
+						t.Fatalf("op %d: peek() = %v, %v", i, ok, peekErr)
+					}
+					err = q.pop(seq, op.kind == "reject")
+				case "restart":
+					q, err = openQueue(dir, "gitlab", retention)
+				case "unacknowledged":
+					err = os.WriteFile(q.path(q.next)+".tmp", []byte("{"), 0600)
+				case "remove":
+					err = os.Remove(q.path(op.seq))
+				case "age":
+					old := time.Now().Add(-2 * retention)
+					entries, _ := os.ReadDir(filepath.Join(q.dir, rejectedDir))
+					for _, entry := range entries {
+						if err == nil {
+							err = os.Chtimes(filepath.Join(q.dir, rejectedDir, entry.Name()), old, old)
+						}
+					}
+				}
+				if err != nil {
+					t.Fatalf("op %d: %s error = %v", i, op.kind, err)
+				}
+			}
+
+			if full != test.wantFull {
+				t.Errorf("queue was full %d times, want %d", full, test.wantFull)
+			}
+			if q.rejectedKept != test.wantRejected {
+				t.Errorf("rejected webhooks kept = %d, want %d", q.rejectedKept, test.wantRejected)
+			}
+
+			var bodies []string
+			for {
+				webhook, seq, ok, err := q.peek()
+				if err != nil {
+					t.Fatalf("peek() error = %v", err)
+				}
+				if !ok {
+					break
+				}
+				bodies = append(bodies, string(webhook.Body))
+				if err := q.pop(seq, false); err != nil {
+					t.Fatalf("pop(%d) error = %v", seq, err)
+				}
+			}
+			if !reflect.DeepEqual(bodies, test.want) {
+				t.Errorf("queued webhooks = %v, want %v", bodies, test.want)
+			}
+
+			// Every webhook was delivered, nothing is left for the next run.
+			q, err = openQueue(dir, "gitlab", retention)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, _, ok, _ := q.peek(); ok {
+				t.Errorf("queue is not empty after a restart")
+			}
+		})
+	}
+}
@@ -0,0 +1,414 @@
+// Package webhook relays the webhooks of internal systems, such as on-prem GitLab or Bitbucket servers that
+// cannot reach the internet, to the platform. Webhooks are queued on disk when accepted and delivered in
+// order per source, so they survive restarts of the agent and outages of the tunnel.
+package webhook
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"log"
+	"mime"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/spf13/viper"
+	"golang.zx2c4.com/wireguard/tun/netstack"
+)
+
+const (
+	// defaultSource is the source of webhooks posted to the root path.
+	defaultSource = "default"
+
+	requestHeaderTimeout = 30 * time.Second
+	requestTimeout       = 2 * time.Minute
+)
+
+// sourcePattern restricts source names, which name the queue directories.
+var sourcePattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]{0,63}$`)
+
+// Headers that describe the request to the relay rather than the webhook, they are not delivered.
+var droppedHeaders = map[string]bool{
+	"Accept-Encoding":     true,
+	"Authorization":       true,
+	"Connection":          true,
+	"Content-Length":      true,
+	"Cookie":              true,
+	"Keep-Alive":          true,
+	"Proxy-Authorization": true,
+	"Proxy-Connection":    true,
+	"Te":                  true,
+	"Trailer":             true,
+	"Transfer-Encoding":   true,
+	"Upgrade":             true,
+}
+
+// Headers that carry the shared secret, checked by authentic. They are never queued nor delivered.
+var secretHeaders = []string{"X-Gitlab-Token", "X-Hub-Signature", "X-Hub-Signature-256"}
+
+// Server accepts webhooks and queues them for delivery.
+type Server struct {
+	server   *http.Server
+	listener net.Listener
+}
+
+// errUnknownSource is returned for sources that are not allowed, or beyond Webhook.MaxSources.
+var errUnknownSource = errors.New("unknown source")
+
+// relay holds the settings of the relay and the queue of every source that posted webhooks.
+var relay = struct {
+	lock       sync.Mutex
+	dir        string
+	secret     string
+	maxBody    int64
+	maxQueued  int
+	maxSources int
+	// sources are the allowed sources, any source is allowed when empty.
+	sources   map[string]bool
+	retention time.Duration
+	delivery  *deliverer
+	queues    map[string]*queue
+}{queues: make(map[string]*queue)}
+
+// Listen listens on Webhook.Listen and starts delivering the webhooks queued by a previous run. Webhooks are
+// delivered to Webhook.URL through the tunnel, or to the platform over HTTPS when it is not set.
+// Webhooks are delivered with the token of the agent, so senders must prove they know Webhook.Secret,
+// unless Webhook.Insecure is set.
+func Listen(tnet *netstack.Net) (*Server, error) {
+	secret := viper.GetString("Webhook.Secret")
+	if secret == "" && !viper.GetBool("Webhook.Insecure") {
+		return nil, errors.New("webhooks need Webhook.Secret, set Webhook.Insecure to accept them without one")
+	}
+	if secret == "" {
+		log.Println("Webhook relay accepts webhooks without a secret")
+	}
+
+	sources := make(map[string]bool)
+	for _, source := range strings.FieldsFunc(viper.GetString("Webhook.Sources"), func(r rune) bool { return r == ',' || r == ' ' }) {
+		if !sourcePattern.MatchString(source) {
+			return nil, fmt.Errorf("invalid webhook source '%s'", source)
+		}
+		sources[source] = true
+	}
+
+	dir := viper.GetString("Webhook.Dir")
+	if dir == "" && viper.GetString("Mapping.StateDir") != "" {
+		dir = filepath.Join(viper.GetString("Mapping.StateDir"), "webhooks")
+	}
+	if dir == "" {
+		return nil, errors.New("webhook queues need Webhook.Dir or Mapping.StateDir")
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("webhook queues: %w", err)
+	}
+
+	delivery, err := newDeliverer(tnet, viper.GetString("Webhook.URL"))
+	if err != nil {
+		return nil, err
+	}
+
+	relay.lock.Lock()
+	relay.dir = dir
+	relay.secret = secret
+	relay.maxBody = viper.GetInt64("Webhook.MaxBodySize")
+	relay.maxQueued = viper.GetInt("Webhook.MaxQueued")
+	relay.maxSources = viper.GetInt("Webhook.MaxSources")
+	relay.sources = sources
+	relay.retention = viper.GetDuration("Webhook.RejectedRetention")
+	relay.delivery = delivery
+	relay.lock.Unlock()
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("webhook queues: %w", err)
+	}
+	// Queues left by a previous run are delivered even when their source is no longer allowed.
+	for _, entry := range entries {
+		if entry.IsDir() && sourcePattern.MatchString(entry.Name()) {
+			if _, err := openSource(entry.Name()); err != nil {
+				return nil, fmt.Errorf("webhook queue %s: %w", entry.Name(), err)
+			}
+		}
+	}
+
+	listener, err := net.Listen("tcp", viper.GetString("Webhook.Listen"))
+	if err != nil {
+		return nil, err
+	}
+	via := "the agent's network"
+	if delivery.tunnel {
+		via = "the tunnel"
+	}
+	log.Printf("Webhook relay listening on %s, delivering to %s through %s\n", listener.Addr(), delivery.url.Redacted(), via)
+
+	return &Server{
+		server: &http.Server{
+			Handler:           http.HandlerFunc(handleWebhook),
+			ReadHeaderTimeout: requestHeaderTimeout,
+			ReadTimeout:       requestTimeout,
+			WriteTimeout:      requestTimeout,
+		},
+		listener: listener,
+	}, nil
+}
+
+// Serve accepts webhooks until the listener fails.
+func (s *Server) Serve() {
+	if err := s.server.Serve(s.listener); err != nil {
+		log.Println("Webhook relay stopped:", err)
+	}
+}
+
+// queueFor returns the queue of a source that posts a webhook, opening it and starting its delivery on first
+// use. Only allowed sources get a queue, and no more than Webhook.MaxSources of them.
+func queueFor(source string) (*queue, error) {
+	relay.lock.Lock()
+	defer relay.lock.Unlock()
+
+	if len(relay.sources) > 0 && !relay.sources[source] {
+		return nil, errUnknownSource
+	}
+	if q, ok := relay.queues[source]; ok {
+		return q, nil
+	}
+	if relay.maxSources > 0 && len(relay.queues) >= relay.maxSources {
+		return nil, errUnknownSource
+	}
+	return openLocked(source)
+}
+
+// openSource opens the queue of a source found on disk.
+func openSource(source string) (*queue, error) {
+	relay.lock.Lock()
+	defer relay.lock.Unlock()
+
+	if q, ok := relay.queues[source]; ok {
+		return q, nil
+	}
+	return openLocked(source)
+}
+
+// openLocked opens the queue of a source and starts its delivery. The caller holds relay.lock.
+func openLocked(source string) (*queue, error) {
+	q, err := openQueue(relay.dir, source, relay.retention)
+	if err != nil {
+		return nil, err
+	}
+	relay.queues[source] = q
+	if pending := q.next - q.first; pending > 0 {
+		log.Printf("Webhook queue %s has %d pending\n", source, pending)
+	}
+
+	go q.deliver(relay.delivery)
+	return q, nil
+}
+
+// handleWebhook validates a webhook and answers 202 once it is queued on disk. The path names the source, such
+// as /gitlab for http://agent:8090/gitlab, webhooks of a source are delivered in the order they were accepted.
+func handleWebhook(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "webhooks must be posted", http.StatusMethodNotAllowed)
+		return
+	}
+
+	source := strings.Trim(r.URL.Path, "/")
+	if source == "" {
+		source = defaultSource
+	}
+	if !sourcePattern.MatchString(source) || !knownSource(source) {
+		http.Error(w, "unknown source", http.StatusNotFound)
+		return
+	}
+
+	relay.lock.Lock()
+	secret, maxBody, maxQueued := relay.secret, relay.maxBody, relay.maxQueued
+	relay.lock.Unlock()
+
+	reader := io.Reader(r.Body)
+	if maxBody > 0 {
+		reader = http.MaxBytesReader(w, r.Body, maxBody)
+	}
+	body, err := io.ReadAll(reader)
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			http.Error(w, "webhook is too large", http.StatusRequestEntityTooLarge)
+			return
+		}
+		http.Error(w, "failed to read webhook", http.StatusBadRequest)
+		return
+	}
+	if len(body) == 0 {
+		http.Error(w, "webhook has no body", http.StatusBadRequest)
+		return
+	}
+	if secret != "" && !authentic(r.Header, body, secret) {
+		http.Error(w, "invalid webhook token or signature", http.StatusUnauthorized)
+		return
+	}
+	if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); strings.HasSuffix(mediaType, "json") && !json.Valid(body) {
+		http.Error(w, "webhook body is not valid JSON", http.StatusBadRequest)
+		return
+	}
+
+	id, err := newID()
+	if err != nil {
+		http.Error(w, "failed to queue webhook", http.StatusInternalServerError)
+		return
+	}
+	header := make(http.Header)
+	for name, values := range r.Header {
+		if !droppedHeaders[name] {
+			header[name] = values
+		}
+	}
+	for _, name := range secretHeaders {
+		header.Del(name)
+	}
+
+	q, err := queueFor(source)
+	if err == nil {
+		err = q.push(Webhook{ID: id, Source: source, ReceivedAt: time.Now().UTC(), Header: header, Body: body}, maxQueued)
+	}
+	if errors.Is(err, errUnknownSource) {
+		http.Error(w, "unknown source", http.StatusNotFound)
+		return
+	}
+	if errors.Is(err, errQueueFull) {
+		w.Header().Set("Retry-After", "60")
+		http.Error(w, "webhook queue is full", http.StatusServiceUnavailable)
+		return
+	}
+	if err != nil {
+		log.Printf("Error queueing webhook of %s: %v\n", source, err)
+		http.Error(w, "failed to queue webhook", http.StatusInternalServerError)
+		return
+	}
+
+	if viper.GetBool("verbose") {
+		log.Printf("Queued webhook %s of %s, %d bytes\n", id, source, len(body))
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// knownSource returns whether a source may post webhooks, before its body is read.
+func knownSource(source string) bool {
+	relay.lock.Lock()
+	defer relay.lock.Unlock()
+
+	if len(relay.sources) > 0 {
+		return relay.sources[source]
+	}
+	_, ok := relay.queues[source]
+	return ok || relay.maxSources <= 0 || len(relay.queues) < relay.maxSources
+}
+
+// authentic checks the shared secret of a webhook: the X-Gitlab-Token of GitLab, or the HMAC signature of
+// GitHub and Bitbucket Server in X-Hub-Signature-256 or X-Hub-Signature.
+func authentic(header http.Header, body []byte, secret string) bool {
+	if token := header.Get("X-Gitlab-Token"); token != "" {
+		return subtle.ConstantTimeCompare([]byte(token), []byte(secret)) == 1
+	}
+
+	for _, name := range []string{"X-Hub-Signature-256", "X-Hub-Signature"} {
+		algorithm, signature, found := strings.Cut(header.Get(name), "=")
+		if !found {
+			continue
+		}
+
+		var newHash func() hash.Hash
+		switch algorithm {
+		case "sha256":
+			newHash = sha256.New
+		case "sha1":
+			newHash = sha1.New
+		default:
+			return false
+		}
+		expected, err := hex.DecodeString(signature)
+		if err != nil {
+			return false
+		}
+		mac := hmac.New(newHash, []byte(secret))
+		mac.Write(body)
+		return hmac.Equal(mac.Sum(nil), expected)
+	}
+	return false
+}
+
+func newID() (string, error) {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(id), nil
+}
+
+// SourceStatus is the delivery state of the webhooks of a source.
+type SourceStatus struct {
+	Source    string
+	Queued    int
+	Delivered int
+	Rejected  int
+	// RejectedKept is the number of rejected webhooks kept on disk, in the rejected directory of the source,
+	// until Webhook.RejectedRetention has passed. They can be removed by hand.
+	RejectedKept int
+	// Blocked is set while the platform refuses the token of the agent, no webhook of the source is delivered
+	// until it is fixed.
+	Blocked         bool
+	LastError       string `json:",omitempty"`
+	LastDeliveredAt time.Time
+}
+
+// Status returns the delivery state of every source, sorted by source.
+func Status() []SourceStatus {
+	relay.lock.Lock()
+	queues := make([]*queue, 0, len(relay.queues))
+	for _, q := range relay.queues {
+		queues = append(queues, q)
+	}
+	relay.lock.Unlock()
+
+	statuses := []SourceStatus{}
+	for _, q := range queues {
+		q.lock.Lock()
+		statuses = append(statuses, SourceStatus{
+			Source:          q.source,
+			Queued:          int(q.next - q.first),
+			Delivered:       q.delivered,
+			Rejected:        q.rejected,
+			RejectedKept:    q.rejectedKept,
+			Blocked:         q.blocked,
+			LastError:       q.lastError,
+			LastDeliveredAt: q.lastDeliveredAt,
+		})
+		q.lock.Unlock()
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].Source < statuses[j].Source })
+	return statuses
+}
+
+// HandleStatus serves the delivery state of every source as JSON.
+func HandleStatus(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(Status())
+	if err != nil {
+		log.Println("Error writing webhook statuses:", err)
+	}
+}